@@ -2,14 +2,26 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"fmt"
 	"github.com/daviddengcn/gdr/gdrf"
 	"github.com/daviddengcn/geps/gep"
 	"github.com/daviddengcn/go-villa"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -18,23 +30,121 @@ const (
 	fn_WEB_DIR    = "web"
 	fn_SOURCE_DIR = "src"
 	fn_GEPSVR_GO  = "gepsvr.go"
+	// generated file registering OnStart/OnStop hooks defined in .go files
+	fn_HOOKS_GO = "geps_hooks.go"
+
+	s_GO_SUFFIX   = ".go"
+	s_TEST_SUFFIX = "_test.go"
+
+	// prefix of generated sources of pages
+	s_SRC_PREFIX = "gep_"
+	// prefix of temporary folders of "geps test" in code.tmp
+	s_TEMP_PREFIX = "gep_"
+	// prefix of build folders in code.tmp, one for each web root
+	s_BUILD_PREFIX = "geps_build_"
 )
 
+// Number of build folders kept in code.tmp, including the current one. Older
+// ones, e.g. of a web root moved or other sites sharing code.tmp, are removed.
+var gKeepTempDirs = 3
+
 type monitor struct {
-	webDir     villa.Path
-	srcDir     villa.Path
-	checkFile  villa.Path
-	exeFile    villa.Path
+	webDir    villa.Path
+	srcDir    villa.Path
+	checkFile villa.Path
+	exeFile   villa.Path
+	// gepsvr.go overriding the embedded one, if not empty
 	gepsvrFile villa.Path
 	tmpRoot    villa.Path
+	// folder of plain .go files compiled into the back server, webDir if empty
+	libDir villa.Path
+
+	// states of pages parsed, by src names, kept between runs to parse only
+	// changed pages
+	pages map[string]*pageState
+	// middleware urls of the last parse, all pages are parsed if changed
+	middlewares string
+
+	// configuration file, an input of builds
+	confFile villa.Path
+	// manifest of the inputs of checkFile, nil if unknown
+	built manifest
+	// manifest of the inputs of the last build, successful or not
+	last manifest
+	// cached hashes of files by paths
+	hashes map[string]hashEntry
+
+	// whether pages failed to build are left out instead of failing the
+	// whole build
+	partial bool
+	// whether in development mode, in which broken pages show the errors
+	// instead of the last good version
+	dev bool
+	// parsing errors of pages left out by the last parse, by src names
+	parseErrors map[string]error
+	// sources of pages in the last successful build, by src names
+	good map[string][]byte
+	// errors of pages left out by the last build, by paths
+	broken map[string][]buildError
+	// sorted urls of pages in the last successful build, hook files excluded
+	pageURLs []string
+}
+
+// fileSig is the size and the modification time of a file, telling whether
+// it has changed.
+type fileSig struct {
+	size    int64
+	modTime time.Time
+}
+
+// pageState is the state of a parsed page
+type pageState struct {
+	// signatures of the page file and the files it depends on, by paths
+	// relative to the web root. Missing files have the zero signature.
+	depends     map[villa.Path]fileSig
+	includeOnly bool
+}
+
+// sigOf returns the signature of a file relative to the web root, and false
+// if not found.
+func (m *monitor) sigOf(path villa.Path) (fileSig, bool) {
+	info, err := m.webDir.Join(path).Stat()
+	if err != nil {
+		return fileSig{}, false
+	}
+	return fileSig{size: info.Size(), modTime: info.ModTime()}, true
+}
+
+// changed returns true if the page file or any file it depends on changed,
+// including one deleted, or created after missing.
+func (st *pageState) changed(m *monitor) bool {
+	for path, sig := range st.depends {
+		if cur, _ := m.sigOf(path); cur != sig {
+			return true
+		}
+	}
+	return false
 }
 
-func newMonitor(web, src, inc, tmp villa.Path) *monitor {
+// writeIfChanged writes data to path, unless the file has the same content,
+// so unchanged files are left alone for the Go build cache.
+func writeIfChanged(path villa.Path, data []byte) error {
+	if old, err := path.ReadFile(); err == nil && bytes.Equal(old, data) {
+		return nil
+	}
+	path.Remove() // in case it is a link
+	return path.WriteFile(data, 0666)
+}
+
+func newMonitor(web, src, inc, tmp, lib villa.Path) *monitor {
 	m := &monitor{
-		webDir:     web,
-		srcDir:     src,
-		tmpRoot:    tmp,
-		gepsvrFile: inc.Join(fn_GEPSVR_GO),
+		webDir:  web,
+		srcDir:  src,
+		tmpRoot: tmp,
+		libDir:  lib,
+	}
+	if inc != "" {
+		m.gepsvrFile = inc.Join(fn_GEPSVR_GO)
 	}
 
 	m.srcDir.MkdirAll(0777)
@@ -42,9 +152,16 @@ func newMonitor(web, src, inc, tmp villa.Path) *monitor {
 	return m
 }
 
+// updateCheckExeFiles sets the executable of the current back server, whose
+// manifest is compared with the inputs for changes, and the executable to
+// build.
 func (m *monitor) updateCheckExeFiles(check, exe villa.Path) {
 	m.checkFile = check
 	m.exeFile = exe
+	m.built = nil
+	if _, err := check.Stat(); err == nil {
+		m.built = loadManifest(check + s_MANIFEST_SUFFIX)
+	}
 }
 
 func (m *monitor) scanFiles() (files map[villa.Path]os.FileInfo) {
@@ -65,30 +182,108 @@ func (m *monitor) scanFiles() (files map[villa.Path]os.FileInfo) {
 	return
 }
 
-func (m *monitor) needUpdate(files map[villa.Path]os.FileInfo) bool {
-	exeInfo, err := m.checkFile.Stat()
-
-	if err != nil {
-		return true
-	}
+// ignoredDir returns true if the .go files in the folder named name are not
+// part of the package, the same as the go tool: vendor, testdata, and those
+// starting with "." or "_".
+func ignoredDir(name string) bool {
+	return name == "vendor" || name == "testdata" ||
+		strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")
+}
 
-	for _, info := range files {
-		if exeInfo.ModTime().Before(info.ModTime()) {
-			return true
+// scanLibFiles returns the .go files under the lib folder, relative to it.
+// _test.go files are included only if tests is true.
+func (m *monitor) scanLibFiles(tests bool) (files map[villa.Path]os.FileInfo) {
+	libDir := m.siteDir()
+	files = make(map[villa.Path]os.FileInfo)
+	libDir.Walk(func(path villa.Path, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
 		}
-	}
+		if info.IsDir() {
+			if path != libDir && ignoredDir(info.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		lower := strings.ToLower(path.S())
+		if !strings.HasSuffix(lower, s_GO_SUFFIX) {
+			return nil
+		}
+		if !tests && strings.HasSuffix(lower, s_TEST_SUFFIX) {
+			return nil
+		}
+		if rel, err := libDir.Rel(path); err == nil {
+			files[libDir.Join(rel)] = info
+		}
+		return nil
+	})
 
-	return false
+	return
 }
 
-func pathToSrcName(path villa.Path) string {
-	return strings.Map(func(r rune) rune {
-		if r == '\\' || r == '/' {
-			return '_'
+// libName returns the name of the copy of a .go file in the build folder.
+// rel is the path relative to the lib folder. _test.go files keep the
+// suffix so that they are still tests.
+func libName(rel villa.Path) string {
+	url := pathToUrl(rel)
+	if strings.HasSuffix(strings.ToLower(url), s_TEST_SUFFIX) {
+		return escapeName("lib_", url[:len(url)-len(s_TEST_SUFFIX)]) + s_TEST_SUFFIX
+	}
+	return escapeName("lib_", url[:len(url)-len(s_GO_SUFFIX)]) + s_GO_SUFFIX
+}
+
+// copyLibFiles copies the .go files into dir, and generates fn_HOOKS_GO
+// registering OnStart and OnStop hooks if defined in them. Names of the files
+// written are returned.
+func (m *monitor) copyLibFiles(libFiles map[villa.Path]os.FileInfo, dir villa.Path) (names []string, err error) {
+	libDir := m.siteDir()
+	var hooks bytes.Buffer
+	fset := token.NewFileSet()
+	for path := range libFiles {
+		rel, err := libDir.Rel(path)
+		if err != nil {
+			return nil, err
+		}
+		src, err := path.ReadFile()
+		if err != nil {
+			return nil, err
+		}
+		name := libName(rel)
+		if err := writeIfChanged(dir.Join(name), src); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if strings.HasSuffix(strings.ToLower(path.S()), s_TEST_SUFFIX) {
+			continue
 		}
 
-		return r
-	}, path.S())
+		f, err := parser.ParseFile(fset, path.S(), src, parser.SkipObjectResolution)
+		if err != nil {
+			// reported by the compiler
+			continue
+		}
+		for _, decl := range f.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv != nil {
+				continue
+			}
+			switch fd.Name.Name {
+			case "OnStart":
+				hooks.WriteString("\tregisterApp(OnStart)\n")
+			case "OnStop":
+				hooks.WriteString("\ttheApp.OnStop(OnStop)\n")
+			}
+		}
+	}
+
+	hooksFile := dir.Join(fn_HOOKS_GO)
+	if hooks.Len() == 0 {
+		hooksFile.Remove()
+		return names, nil
+	}
+	names = append(names, fn_HOOKS_GO)
+	return names, writeIfChanged(hooksFile, []byte("// Code generated by geps. DO NOT EDIT.\n\npackage main\n\nfunc init() {\n"+
+		hooks.String()+"}\n"))
 }
 
 func pathToUrl(path villa.Path) string {
@@ -101,35 +296,46 @@ func pathToUrl(path villa.Path) string {
 	}, path.S())
 }
 
-func greater(a, b villa.Path) bool {
-	if len(a) > len(b) {
-		return true
-	}
+// srcName returns the name of the generated Go file(without ".go") and the
+// suffix of the generated function for a page of url. Letters are lowered and
+// other characters are escaped with '_', so names are always valid
+// identifiers and file names, and different urls never get the same name,
+// even on case-insensitive file systems.
+func srcName(url string) string {
+	return escapeName(s_SRC_PREFIX, url)
+}
 
-	return a > b
+// escapeName returns prefix followed by url escaped as described in srcName
+func escapeName(prefix, url string) string {
+	var out bytes.Buffer
+	out.WriteString(prefix)
+	for _, r := range url {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			out.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			out.WriteString("_u")
+			out.WriteRune(r - 'A' + 'a')
+		case r == '_':
+			out.WriteString("__")
+		case r == '/':
+			out.WriteString("_s")
+		case r == '.':
+			out.WriteString("_d")
+		case r == '-':
+			out.WriteString("_h")
+		default:
+			fmt.Fprintf(&out, "_x%x_", r)
+		}
+	}
+	return out.String()
 }
 
-func (m *monitor) genSourceNames(files map[villa.Path]os.FileInfo) (srcPath map[string]villa.Path) {
+// srcNames maps the names returned by srcName to the paths of files
+func srcNames(files map[villa.Path]os.FileInfo) (srcPath map[string]villa.Path) {
 	srcPath = make(map[string]villa.Path)
-	pathSrc := make(map[villa.Path]string)
 	for path := range files {
-		src := pathToSrcName(path)
-		//log.Println("src:", src)
-		for {
-			p, ok := srcPath[src]
-			if !ok {
-				srcPath[src], pathSrc[path] = path, src
-				break
-			}
-
-			if greater(p, path) {
-				// replace (src, p) with (src, path)
-				srcPath[src], pathSrc[path] = path, src
-				// try find another src for p
-				path = p
-			}
-			src += "_"
-		}
+		srcPath[srcName(pathToUrl(path))] = path
 	}
 
 	return
@@ -149,91 +355,451 @@ func (sg *sourceGenerator) Load(path villa.Path) (string, error) {
 	return string(src), nil
 }
 
+// Kinds of srcPart
+const (
+	pk_RAW = iota
+	pk_CODE
+	pk_EVAL
+)
+
+// goString returns a Go string literal of s. Raw string literals are used
+// when possible to keep the multi-line HTML readable.
+func goString(s string) string {
+	if strings.ContainsAny(s, "`\r\x00\ufeff") || !utf8.ValidString(s) {
+		return strconv.Quote(s)
+	}
+	return "`" + s + "`"
+}
+
+// srcPart is the part generated by sourceGenerator
+type srcPart struct {
+	kind int
+	src  string
+}
+
+// String returns the Go source of a code or eval part. Raw parts are
+// generated by genGoSource.
+func (p srcPart) String() string {
+	switch p.kind {
+	case pk_EVAL:
+		return fmt.Sprintf("__print__(__response__, %s)\n", p.src)
+	}
+	return p.src + "\n"
+}
+
 func (sg *sourceGenerator) GenRawPart(src string) interface{} {
-	return fmt.Sprintf("__print__(__response__, %q)\n", src)
+	return srcPart{kind: pk_RAW, src: src}
 }
 
 func (sg *sourceGenerator) GenCodePart(src string) interface{} {
-	return string(src) + "\n"
+	return srcPart{kind: pk_CODE, src: src}
 }
 
 func (sg *sourceGenerator) GenEvalPart(src string) interface{} {
-	return fmt.Sprintf("__print__(__response__, %s)\n", src)
+	return srcPart{kind: pk_EVAL, src: src}
 }
 
 func (sg *sourceGenerator) Error(message string) {
 	log.Println("GEP parse error:", message)
 }
 
-const sTemplate = `package main
+// generatorVersion is a part of the inputs of a build. Change it when the
+// generated Go source of pages changes other than by sTemplate.
+const generatorVersion = "1"
+
+// sTemplate is the template of the generated Go source of a page
+var sTemplate = template.Must(template.New("page").Parse(`// Code generated by geps from {{.Url}}. DO NOT EDIT.
 
-import(
-#_imports_#)
+package main
+
+import (
+{{range .Imports}}	{{printf "%q" .}}
+{{end}})
 
+{{if .App}}
 func init() {
-	registerPath(#_url_path_#, __process_#_func_name_#)
+	registerApp(__process_{{.Name}})
+}
+
+func __process_{{.Name}}(app *App) error {
+{{.Body}}	return nil
+}
+{{else}}{{if not .Middleware}}
+func init() {
+	registerPath({{printf "%q" .Path}}, __process_{{.Name}}{{range .Middlewares}},
+		middleware{ {{printf "%q" .Path}}, __process_{{.Name}} }{{end}})
+}
+{{end}}{{if .Raws}}
+var (
+{{range .Raws}}	{{.Name}} = []byte({{.Lit}})
+{{end}})
+{{end}}
+func __process_{{.Name}}(response http.ResponseWriter, request *http.Request{{if .Middleware}}, __next__ http.HandlerFunc{{end}}) {
+	__response__ := {{if .API}}__newAPIPage__{{else}}__newPage__{{end}}(response, request, {{.Buffer}})
+	defer __response__.finish()
+	response = __response__
+	page := __response__
+	_ = page
+{{- if .Middleware}}
+	next := func() { __next__(response, request) }
+	_ = next
+{{- end}}
+{{.Body}}}
+{{end}}`))
+
+// rawVar is a package level variable of a raw part
+type rawVar struct {
+	Name, Lit string
+}
+
+// fn_MIDDLEWARE is the name of middleware files. The code of a middleware
+// file wraps every page in its directory and subdirectories, and calls
+// next() to continue.
+const fn_MIDDLEWARE = "_middleware" + s_SUFFIX
+
+// fn_APP is the name of the application file in the web root. Its code is
+// the OnStart hook of the back server, with app as the shared *App.
+const fn_APP = "_app" + s_SUFFIX
+
+// isMiddleware returns true if url is a middleware file
+func isMiddleware(url string) bool {
+	return url == fn_MIDDLEWARE || strings.HasSuffix(url, "/"+fn_MIDDLEWARE)
+}
+
+// isHook returns true if url is _app.gep or a middleware file, which are
+// hooks of pages instead of pages
+func isHook(url string) bool {
+	return url == fn_APP || isMiddleware(url)
+}
+
+// middlewaresOf returns the urls of middleware files applying to the page of
+// url, from the root down.
+func middlewaresOf(url string, urls villa.StrSet) (middlewares []string) {
+	dir := ""
+	for {
+		if mw := dir + fn_MIDDLEWARE; urls.In(mw) {
+			middlewares = append(middlewares, mw)
+		}
+		i := strings.Index(url[len(dir):], "/")
+		if i < 0 {
+			return middlewares
+		}
+		dir = url[:len(dir)+i+1]
+	}
 }
 
-func __process_#_func_name_#(response http.ResponseWriter, request *http.Request) {
-	__response__ := response
-	_ = __response__
-#_body_#}
-`
+// posError is an error at a position of a GEP file
+type posError struct {
+	pos gep.Pos
+	msg string
+}
+
+func (e *posError) Error() string {
+	return e.pos.String() + ": " + e.msg
+}
 
-func genGoSource(parts *gep.GepParts, url, func_name string) string {
+// isAPIPage returns true if the page is a JSON API page, i.e. named as
+// *.json.gep or marked by <%!page api%>.
+func isAPIPage(parts *gep.GepParts, url string) bool {
+	return parts.Mode == "api" || strings.HasSuffix(strings.ToLower(url), ".json"+s_SUFFIX)
+}
+
+// genGoSource generates the formatted Go source of a page. Consecutive raw
+// parts are merged into package level []byte variables, and statements are
+// mapped to their GEP source by line directives. In JSON API
+// pages and _app.gep, only code parts are allowed, other than white spaces,
+// which are also dropped in middleware files. middlewares
+// are the urls of middleware files wrapping the page.
+func genGoSource(parts *gep.GepParts, url, name string, middlewares []string) (string, error) {
+	api, mw, app := isAPIPage(parts, url), isMiddleware(url), url == fn_APP
 	parts.Imports.Put("fmt", "net/http", "strings")
-	//log.Println("Imports:", parts.Imports)
-	src := sTemplate
-	var out bytes.Buffer
+	imports := make([]string, 0, len(parts.Imports))
 	for imp := range parts.Imports {
-		out.WriteString("\t" + strconv.Quote(imp) + "\n")
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	buffer := parts.Buffer
+	if buffer < 0 {
+		buffer = gPageBuffer
+	}
+
+	var body bytes.Buffer
+	var raws []rawVar
+	for i := 0; i < len(parts.Parts); i++ {
+		part, _ := parts.Parts[i].(srcPart)
+		var pos gep.Pos
+		if i < len(parts.Poses) {
+			pos = parts.Poses[i]
+		}
+		if part.kind == pk_RAW {
+			for i+1 < len(parts.Parts) {
+				next, ok := parts.Parts[i+1].(srcPart)
+				if !ok || next.kind != pk_RAW {
+					break
+				}
+				part.src += next.src
+				i++
+			}
+		}
+		if (api || mw || app) && part.kind == pk_RAW && strings.TrimSpace(part.src) == "" {
+			// white spaces around code
+			continue
+		}
+		if (api || app) && part.kind != pk_CODE {
+			if part.kind == pk_RAW {
+				// locate the first non-space character
+				pos = pos.Advance(part.src[:len(part.src)-len(strings.TrimLeftFunc(part.src, unicode.IsSpace))])
+			}
+			msg := "output not allowed in JSON API page, use Respond()"
+			if app {
+				msg = "output not allowed in " + fn_APP
+			}
+			return "", &posError{pos: pos, msg: msg}
+		}
+		if pos.File != "" {
+			// line directive mapping the part to the GEP source
+			fmt.Fprintf(&body, "//line %s:%d:%d\n", pos.File, pos.Line, pos.Col)
+		}
+		if part.kind == pk_RAW {
+			raw := rawVar{Name: fmt.Sprintf("__raw_%s_%d", name, len(raws)), Lit: goString(part.src)}
+			raws = append(raws, raw)
+			fmt.Fprintf(&body, "__response__.Write(%s)\n", raw.Name)
+			continue
+		}
+		body.WriteString(part.String())
+	}
+
+	type route struct {
+		Path, Name string
+	}
+	var mws []route
+	for _, mw := range middlewares {
+		mws = append(mws, route{Path: "/" + mw, Name: srcName(mw)})
+	}
+
+	var out bytes.Buffer
+	err := sTemplate.Execute(&out, struct {
+		Url, Path, Name      string
+		API, Middleware, App bool
+		Buffer               int
+		Imports              []string
+		Middlewares          []route
+		Raws                 []rawVar
+		Body                 string
+	}{
+		Url:         url,
+		Path:        "/" + url,
+		Name:        name,
+		API:         api,
+		Middleware:  mw,
+		App:         app,
+		Buffer:      buffer,
+		Imports:     imports,
+		Middlewares: mws,
+		Raws:        raws,
+		Body:        body.String(),
+	})
+	if err != nil {
+		log.Println("Generating source of", url, "failed:", err)
+		return "", err
 	}
-	src = strings.Replace(src, "#_imports_#", out.String(), -1)
-	src = strings.Replace(src, "#_url_path_#", strconv.Quote("/"+url), -1)
-	src = strings.Replace(src, "#_func_name_#", func_name, -1)
 
-	out.Reset()
-	for _, part := range parts.Parts {
-		out.WriteString("\t" + fmt.Sprint(part))
+	src, err := formatSource(out.Bytes())
+	if err != nil {
+		// Keep the unformatted source, errors are reported by the compiler
+		return out.String(), nil
 	}
-	src = strings.Replace(src, "#_body_#", out.String(), -1)
-	return src
+	return string(src), nil
+}
+
+// stmtPositions returns the positions of statements in f in the order of
+// appearance, adjusted by line directives if adjusted is true.
+func stmtPositions(fset *token.FileSet, f *ast.File, adjusted bool) (poses []token.Position) {
+	ast.Inspect(f, func(n ast.Node) bool {
+		switch n.(type) {
+		case *ast.BlockStmt, *ast.EmptyStmt:
+		case ast.Stmt:
+			poses = append(poses, fset.PositionFor(n.Pos(), adjusted))
+		}
+		return true
+	})
+	return poses
 }
 
+// formatSource formats a generated source with line directives. gofmt may
+// split a code part into several lines, so the directives are dropped from
+// the formatted source, and one is inserted before every statement line not
+// mapped to the GEP source of the statement by the previous one.
+func formatSource(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	origs := stmtPositions(fset, f, true)
+	var formatted bytes.Buffer
+	if err := format.Node(&formatted, fset, f); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, line := range strings.SplitAfter(formatted.String(), "\n") {
+		if !strings.HasPrefix(line, "//line ") {
+			lines = append(lines, line)
+		}
+	}
+	fset = token.NewFileSet()
+	f, err = parser.ParseFile(fset, "", strings.Join(lines, ""), 0)
+	if err != nil {
+		return nil, err
+	}
+	poses := stmtPositions(fset, f, false)
+	if len(poses) != len(origs) {
+		return nil, fmt.Errorf("statements changed by formatting: %d, %d", len(origs), len(poses))
+	}
+
+	// the GEP positions of statements starting lines, by line numbers
+	targets := make(map[int]token.Position)
+	for i, pos := range poses {
+		orig := origs[i]
+		if orig.Filename == "" || strings.TrimSpace(lines[pos.Line-1][:pos.Column-1]) != "" {
+			// not mapped, or not the first on the line
+			continue
+		}
+		if _, ok := targets[pos.Line]; !ok {
+			// the column of the directive is that of the line start
+			orig.Column -= pos.Column - 1
+			if orig.Column < 1 {
+				orig.Column = 1
+			}
+			targets[pos.Line] = orig
+		}
+	}
+
+	var out bytes.Buffer
+	// line n of the output is mapped to line base + n of file
+	file, base, n := "", 0, 0
+	for i, line := range lines {
+		if t, ok := targets[i+1]; ok && (t.Filename != file || base+n+1 != t.Line) {
+			fmt.Fprintf(&out, "//line %s:%d:%d\n", t.Filename, t.Line, t.Column)
+			n++
+			file, base = t.Filename, t.Line-n-1
+		}
+		out.WriteString(line)
+		n++
+	}
+	return out.Bytes(), nil
+}
+
+// middlewareSet returns the urls of middleware files in srcFiles
+func middlewareSet(srcFiles map[string]villa.Path) villa.StrSet {
+	middlewares := villa.NewStrSet()
+	for _, path := range srcFiles {
+		if url := pathToUrl(path); isMiddleware(url) {
+			middlewares.Put(url)
+		}
+	}
+	return middlewares
+}
+
+// leaveOut records the parsing error of a page for a partial build and
+// returns true, or returns false if partial builds are disabled.
+func (m *monitor) leaveOut(src string, path villa.Path, err error) bool {
+	if !m.partial || pathToUrl(path) == fn_APP {
+		return false
+	}
+	log.Println("Parsing failed, page left out:", err)
+	m.parseErrors[src] = err
+	return true
+}
+
+// parse generates the Go sources of pages in srcFiles. Only pages that are
+// new, or whose file or dependencies changed since the last parse, are
+// parsed. includeonly pages are removed from srcFiles.
 func (m *monitor) parse(srcFiles map[string]villa.Path) error {
-	cnt := 0
+	middlewares := middlewareSet(srcFiles)
+	mwList := middlewares.Elements()
+	sort.Strings(mwList)
+	if mwKey := strings.Join(mwList, "\n"); m.pages == nil || mwKey != m.middlewares {
+		// middlewares are generated into pages, parse all
+		m.pages, m.middlewares = make(map[string]*pageState), mwKey
+	}
+	for src := range m.pages {
+		if _, ok := srcFiles[src]; !ok {
+			delete(m.pages, src)
+		}
+	}
+
+	m.parseErrors = make(map[string]error)
 	sg := sourceGenerator{m: m}
 	for src, path := range srcFiles {
-		url := pathToUrl(path)
-		gepSrc, err := sg.Load(path)
-		if err == nil {
-			parts, err := gep.Parse(&sg, gepSrc)
-			if err != nil {
-				return err
+		if st := m.pages[src]; st != nil && !st.changed(m) {
+			if st.includeOnly {
+				delete(srcFiles, src)
+				continue
+			}
+			if _, err := m.srcDir.Join(src + ".go").Stat(); err == nil {
+				continue
 			}
+		}
+		delete(m.pages, src)
 
-			if parts.IncludeOnly {
-				delete(srcFiles, src)
-				log.Println(path, "IncludeOnly, ignored!")
+		url := pathToUrl(path)
+		parts, err := gep.ParseFile(&sg, path)
+		if err != nil {
+			if m.leaveOut(src, path, err) {
 				continue
 			}
-			goSrc := genGoSource(parts, url, fmt.Sprint(cnt))
-			cnt++
-
-			srcFile := m.srcDir.Join(src + ".go")
-			//fmt.Println("Generating", srcFile, "...")
-			///err = srcFile.WriteFile([]byte(goSrc), 0666)
-			srcF, err := srcFile.Create()
-			if err != nil {
-				return err
+			return err
+		}
+		st := &pageState{depends: make(map[villa.Path]fileSig)}
+		for _, dep := range append(parts.Depends.Elements(), path.S()) {
+			dep := villa.Path(filepath.Clean(dep))
+			// a missing include is kept, so the page is parsed again once
+			// it is created
+			sig, _ := m.sigOf(dep)
+			st.depends[dep] = sig
+		}
+
+		if parts.IncludeOnly && !isHook(url) {
+			delete(srcFiles, src)
+			log.Println(path, "IncludeOnly, ignored!")
+			st.includeOnly = true
+			m.pages[src] = st
+			continue
+		}
+		var mws []string
+		if !isHook(url) {
+			mws = middlewaresOf(url, middlewares)
+		}
+		goSrc, err := genGoSource(parts, url, src, mws)
+		if err != nil {
+			if m.leaveOut(src, path, err) {
+				continue
 			}
-			err = gdrf.FilterFile(villa.Path(src+".go"), goSrc, srcF)
-			srcF.Close()
+			return err
+		}
 
-			if err != nil {
-				return err
+		var out bytes.Buffer
+		if err := gdrf.FilterFile(villa.Path(src+".go"), goSrc, &out); err != nil {
+			if m.leaveOut(src, path, err) {
+				continue
 			}
+			return err
 		}
+		if err := writeIfChanged(m.srcDir.Join(src+".go"), out.Bytes()); err != nil {
+			return err
+		}
+		m.pages[src] = st
+	}
+
+	// sources of deleted and include-only pages
+	keep := villa.NewStrSet()
+	for src := range srcFiles {
+		keep.Put(src + ".go")
+	}
+	if err := removeStale(m.srcDir, s_SRC_PREFIX, keep); err != nil {
+		log.Println("Removing stale sources:", err)
 	}
 
 	return nil
@@ -247,34 +813,102 @@ func copyFile(src, dst villa.Path) (err error) {
 	return dst.WriteFile(bytes, 0666)
 }
 
-func safeLink(src, dst villa.Path) (err error) {
-	err = src.Symlink(dst)
-	if err == nil {
-		return nil
+// buildDir returns the folder for building the back server. It is kept
+// between builds, so unchanged files are left alone and the Go build cache
+// is effective.
+func (m *monitor) buildDir() villa.Path {
+	root := m.tmpRoot
+	if root == "" {
+		root = villa.Path(os.TempDir())
 	}
+	// different sites never share a build folder
+	sum := sha1.Sum([]byte(m.webDir.S()))
+	return root.Join(fmt.Sprintf("%s%x", s_BUILD_PREFIX, sum[:4]))
+}
 
-	return copyFile(src, dst)
+// removeStale removes .go files in dir starting with prefix other than
+// those in keep
+func removeStale(dir villa.Path, prefix string, keep villa.StrSet) error {
+	infos, err := dir.ReadDir()
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if !info.IsDir() && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, s_GO_SUFFIX) && !keep.In(name) {
+			if err := dir.Join(name).Remove(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func (m *monitor) compile(srcFiles map[string]villa.Path) (err error) {
-	// Create temporary directory
-	tmpDir, err := villa.Path(m.tmpRoot).TempDir("gep_")
+// removeOldTempDirs removes old folders in code.tmp, i.e. build folders
+// (geps_build_*) and those left by "geps test" (gep_*). The current build
+// folder and the newest others are kept, gKeepTempDirs in total. Nothing is
+// removed in the system temporary folder, which may be shared.
+func (m *monitor) removeOldTempDirs() error {
+	if m.tmpRoot == "" {
+		return nil
+	}
+	infos, err := m.tmpRoot.ReadDir()
 	if err != nil {
-		log.Println("Creating tmpDir failed:", err)
 		return err
 	}
+	current := filepath.Base(m.buildDir().S())
+	var dirs []os.FileInfo
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() && name != current && (strings.HasPrefix(name, s_BUILD_PREFIX) || strings.HasPrefix(name, s_TEMP_PREFIX)) {
+			dirs = append(dirs, info)
+		}
+	}
+	keep := gKeepTempDirs - 1
+	if keep < 0 {
+		keep = 0
+	}
+	if len(dirs) <= keep {
+		return nil
+	}
+	// newest first
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].ModTime().After(dirs[j].ModTime())
+	})
+	for _, info := range dirs[keep:] {
+		log.Println("Removing old temporary folder:", info.Name())
+		if err := m.tmpRoot.Join(info.Name()).RemoveAll(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Link gepsrv.go
-	gepsvrGo := tmpDir.Join(fn_GEPSVR_GO)
-	err = safeLink(m.gepsvrFile, gepsvrGo)
+func (m *monitor) compile(srcFiles map[string]villa.Path, libFiles map[villa.Path]os.FileInfo) (err error) {
+	tmpDir := m.buildDir()
+	if err = tmpDir.MkdirAll(0777); err != nil {
+		log.Println("Creating build folder failed:", err)
+		return err
+	}
+	// the modification time tells removeOldTempDirs the folder is in use
+	now := time.Now()
+	os.Chtimes(tmpDir.S(), now, now)
+
+	// Write gepsrv.go
+	err = m.writeGepsvr(tmpDir)
 	if err != nil {
-		log.Println("Linking", m.gepsvrFile, "to temp folder:", err)
+		log.Println("Writing gepsvr.go to build folder:", err)
 		return
 	}
-
-	// Link source go files
-	for src := range srcFiles {
-		safeLink(m.srcDir.Join(src+".go"), tmpDir.Join(src+".go"))
+	// Copy plain go files
+	libNames, err := m.copyLibFiles(libFiles, tmpDir)
+	if err != nil {
+		log.Println("Copying go files to build folder:", err)
+		return
+	}
+	if err = m.writeGoMod(tmpDir); err != nil {
+		log.Println("Writing go.mod to build folder:", err)
+		return
 	}
 
 	exeFile := m.exeFile
@@ -287,39 +921,208 @@ func (m *monitor) compile(srcFiles map[string]villa.Path) (err error) {
 	}
 	defer cf.Close()
 
-	log.Println("Compiling", tmpDir, "to", exeFile)
+	broken := make(map[string]*brokenPage)
+	for src, err := range m.parseErrors {
+		broken[src] = m.newBrokenPage(src, errorsOf(err))
+	}
+	middlewares := middlewareSet(srcFiles)
+	for {
+		keep := villa.NewStrSet(fn_GEPSVR_GO)
+		keep.Put(libNames...)
+		// Copy source go files, or fallbacks of broken pages
+		for src, path := range srcFiles {
+			var goSrc []byte
+			if goSrc, err = m.pageSource(src, path, broken[src], middlewares); err != nil {
+				log.Println("Reading generated source:", err)
+				return
+			}
+			if err = writeIfChanged(tmpDir.Join(src+".go"), goSrc); err != nil {
+				log.Println("Copying generated source to build folder:", err)
+				return
+			}
+			keep.Put(src + ".go")
+		}
+		if err = removeStale(tmpDir, "", keep); err != nil {
+			log.Println("Removing stale files in build folder:", err)
+			return
+		}
 
-	// Compile
-	cmd := villa.Path("go").Command("build", "-o", exeFile.S())
-	cmd.Stdout = cf
-	cmd.Stderr = cf
-	cmd.Dir = tmpDir.S()
-	err = cmd.Run()
+		log.Println("Compiling", tmpDir, "to", exeFile)
 
-	if err != nil {
+		// Compile. -trimpath removes the build folder from the executable so
+		// that identical sources give identical executables.
+		var out bytes.Buffer
+		cmd := goCommand(tmpDir, "build", "-trimpath", "-o", exeFile.S())
+		cmd.Stdout = io.MultiWriter(cf, &out)
+		cmd.Stderr = cmd.Stdout
+		if err = cmd.Run(); err == nil {
+			break
+		}
 		log.Println("Compiling failed:", err)
-		return err
+		errs := parseBuildErrors(out.String())
+		if !m.partial || !m.markBroken(broken, srcFiles, errs) {
+			return &buildFailure{err: err, errors: errs}
+		}
+		log.Println("Compiling again without broken pages")
+	}
+
+	good := make(map[string][]byte)
+	m.broken = make(map[string][]buildError)
+	m.pageURLs = nil
+	for src, path := range srcFiles {
+		if b := broken[src]; b != nil {
+			m.broken["/"+pathToUrl(path)] = b.errors
+			if b.good {
+				good[src] = m.good[src]
+			}
+			continue
+		}
+		if goSrc, err := tmpDir.Join(src + ".go").ReadFile(); err == nil {
+			good[src] = goSrc
+		}
+		if url := pathToUrl(path); !isHook(url) {
+			m.pageURLs = append(m.pageURLs, "/"+url)
+		}
+	}
+	sort.Strings(m.pageURLs)
+	m.good = good
+	if len(m.broken) > 0 {
+		log.Println("Pages left out:", len(m.broken))
 	}
 
 	return nil
 }
 
+// run builds a new back server if the set of inputs or any of their contents
+// changed since the current back server or the last build. It returns true
+// if built successfully.
 func (m *monitor) run() (changed bool) {
 	files := m.scanFiles()
-	if !m.needUpdate(files) {
+	libFiles := m.scanLibFiles(false)
+	inputs := m.inputManifest(files, libFiles, m.built)
+	if m.built != nil && inputs.equals(m.built) {
+		// back to the inputs of the current back server, e.g. a change undone
+		m.last = inputs
+		if status, _ := gBuildStatus.Get().(*buildStatus); status != nil && !status.OK {
+			gBuildStatus.Set(&buildStatus{Time: time.Now(), OK: true, Broken: m.broken})
+		}
 		return false
 	}
-	srcFiles := m.genSourceNames(files)
+	if m.last != nil && inputs.equals(m.last) {
+		return false
+	}
+	if m.built != nil {
+		log.Println("Changed:", strings.Join(inputs.diff(m.built), ", "))
+	}
+	m.last = inputs
+
+	status := &buildStatus{Time: time.Now()}
+	defer gBuildStatus.Set(status)
+
+	srcFiles := srcNames(files)
 	log.Println("Compiling:", srcFiles)
 	err := m.parse(srcFiles)
 	if err != nil {
 		log.Println("Parsing source files:", err)
+		status.Errors = errorsOf(err)
 		return false
 	}
-	err = m.compile(srcFiles)
+	err = m.compile(srcFiles, libFiles)
 	if err != nil {
 		log.Println("Compiling:", err)
+		status.Errors = errorsOf(err)
 		return false
 	}
+	status.OK, status.Broken = true, m.broken
+	if err := m.removeOldTempDirs(); err != nil {
+		log.Println("Removing old temporary folders:", err)
+	}
+
+	// dependencies are updated by parse. Entries hashed before parsing are
+	// kept, so changes during the build are found in the next run.
+	built := m.inputManifest(files, libFiles, nil)
+	for path := range built {
+		if e, ok := inputs[path]; ok {
+			built[path] = e
+		}
+	}
+	if err := built.save(m.exeFile + s_MANIFEST_SUFFIX); err != nil {
+		log.Println("Saving manifest:", err)
+	}
 	return true
 }
+
+// hold takes the current inputs as seen, so that they are not built until
+// changed again, e.g. after rolling back to an older generation.
+func (m *monitor) hold() {
+	m.last = m.inputManifest(m.scanFiles(), m.scanLibFiles(false), m.built)
+}
+
+// genPackage generates the Go package of the back server into dir, with
+// the _test.go files if tests is true. It returns the number of pages.
+func genPackage(dir villa.Path, tests bool) (int, error) {
+	if err := dir.MkdirAll(0777); err != nil {
+		return 0, err
+	}
+
+	m := newMonitor(gPaths.webRoot, dir, gPaths.inc, gPaths.tmp, gPaths.lib)
+	srcFiles := srcNames(m.scanFiles())
+	if err := m.parse(srcFiles); err != nil {
+		return 0, err
+	}
+	if err := m.writeGepsvr(dir); err != nil {
+		return 0, err
+	}
+	if _, err := m.copyLibFiles(m.scanLibFiles(tests), dir); err != nil {
+		return 0, err
+	}
+	if err := m.writeGoMod(dir); err != nil {
+		return 0, err
+	}
+	return len(srcFiles), nil
+}
+
+// genCommand implements "geps gen [dir]". It generates the Go package of the
+// back server into dir(default "gen") for inspection, without compiling it.
+func genCommand(args []string) int {
+	dir := villa.Path("gen")
+	if len(args) > 0 {
+		dir = villa.Path(args[0])
+	}
+	dir = dir.AbsPath()
+
+	n, err := genPackage(dir, false)
+	if err != nil {
+		log.Println("Generating", dir, "failed:", err)
+		return 1
+	}
+
+	log.Printf("Generated %d pages into %v", n, dir)
+	return 0
+}
+
+// testCommand implements "geps test [go test flags]". It generates the Go
+// package of the back server with the _test.go files into a temporary
+// folder, and runs go test in it.
+func testCommand(args []string) int {
+	dir, err := villa.Path(gPaths.tmp).TempDir(s_TEMP_PREFIX + "test_")
+	if err != nil {
+		log.Println("Creating temporary folder failed:", err)
+		return 1
+	}
+	defer dir.RemoveAll()
+
+	if _, err := genPackage(dir, true); err != nil {
+		log.Println("Generating", dir, "failed:", err)
+		return 1
+	}
+
+	cmd := goCommand(dir, append([]string{"test"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Println("Testing failed:", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"fmt"
+	"github.com/daviddengcn/geps/gep"
+	"github.com/daviddengcn/go-villa"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+)
+
+func TestSrcName(t *testing.T) {
+	cases := []struct{ url, name string }{
+		{"index.gep", "gep_index_dgep"},
+		{"admin/Users.gep", "gep_admin_s_uusers_dgep"},
+		{"_my-page.gep", "gep___my_hpage_dgep"},
+		{"a b.gep", "gep_a_x20_b_dgep"},
+	}
+	for _, c := range cases {
+		if act := srcName(c.url); act != c.name {
+			t.Errorf("srcName(%q): expected %q, but got %q", c.url, c.name, act)
+		}
+	}
+
+	// names of different urls should be different
+	urls := []string{"a/b.gep", "a_b.gep", "a_sb.gep", "A.gep", "a.gep", "_ua.gep"}
+	names := make(map[string]string)
+	for _, url := range urls {
+		name := srcName(url)
+		if prev, ok := names[name]; ok {
+			t.Errorf("srcName(%q) and srcName(%q) are both %q", prev, url, name)
+		}
+		names[name] = url
+	}
+}
+
+func TestGenGoSource_api(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_api_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	files := map[string]string{
+		"ok.json.gep":  "<%!import \"strconv\"%>\n<% Respond(strconv.Itoa(1)) %>\n",
+		"bad.json.gep": "<% x := 1 %>\n  <p><%= x %></p>",
+		"eval.gep":     "<%!page api%><%= 1 %>",
+	}
+	sg := sourceGenerator{m: &monitor{webDir: root}}
+	errs := map[string]string{}
+	for fn, src := range files {
+		if err := root.Join(fn).WriteFile([]byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		parts, err := gep.ParseFile(&sg, villa.Path(fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := genGoSource(parts, fn, srcName(fn), nil); err != nil {
+			errs[fn] = err.Error()
+		}
+	}
+	expected := map[string]string{
+		"bad.json.gep": "bad.json.gep:2:3: output not allowed in JSON API page, use Respond()",
+		"eval.gep":     "eval.gep:1:17: output not allowed in JSON API page, use Respond()",
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Expected errors %v, but got %v", expected, errs)
+	}
+}
+
+// genTestSource generates the Go source of the page fn of src in root
+func genTestSource(t *testing.T, root villa.Path, fn, src string) string {
+	if err := root.Join(fn).WriteFile([]byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	sg := sourceGenerator{m: &monitor{webDir: root}}
+	parts, err := gep.ParseFile(&sg, villa.Path(fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	goSrc, err := genGoSource(parts, fn, srcName(fn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return goSrc
+}
+
+// stmtLines returns the GEP positions of statements in a generated source
+// by their code.
+func stmtLines(t *testing.T, goSrc string) map[string]string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", goSrc, 0)
+	if err != nil {
+		t.Fatalf("Parsing generated source: %v\n%s", err, goSrc)
+	}
+	lines := strings.Split(goSrc, "\n")
+	poses := make(map[string]string)
+	ast.Inspect(f, func(n ast.Node) bool {
+		if _, ok := n.(*ast.BlockStmt); !ok && n != nil {
+			if _, ok := n.(ast.Stmt); ok {
+				pos := fset.PositionFor(n.Pos(), false)
+				code := strings.TrimSpace(lines[pos.Line-1])
+				if _, ok := poses[code]; !ok {
+					adj := fset.PositionFor(n.Pos(), true)
+					poses[code] = fmt.Sprintf("%s:%d", adj.Filename, adj.Line)
+				}
+			}
+		}
+		return true
+	})
+	return poses
+}
+
+func TestGenGoSource(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_gen_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	goSrc := genTestSource(t, root, "a.gep", "<h1>\n<%!import \"strings\"%>Title</h1>\n<%   x := strings.ToUpper(\"a\")%>\n<%= x %>\n")
+	if formatted, err := format.Source([]byte(goSrc)); err != nil || string(formatted) != goSrc {
+		t.Errorf("Expected gofmt-ed source, but got %v\n%s", err, goSrc)
+	}
+	// raws separated only by the import are merged
+	if !strings.Contains(goSrc, "__raw_gep_a_dgep_0 = []byte(`<h1>\nTitle</h1>\n`)") {
+		t.Errorf("Expected merged raws in a variable, but got\n%s", goSrc)
+	}
+	if strings.Contains(goSrc, "__raw_gep_a_dgep_3") {
+		t.Errorf("Expected 3 raw variables, but got\n%s", goSrc)
+	}
+	if !strings.Contains(goSrc, "//line a.gep:3:5\n\tx := strings.ToUpper(\"a\")") {
+		t.Errorf("Expected a line directive at the code, but got\n%s", goSrc)
+	}
+	expected := map[string]string{
+		"__response__.Write(__raw_gep_a_dgep_0)": "a.gep:1",
+		`x := strings.ToUpper("a")`:              "a.gep:3",
+		"__print__(__response__, x)":             "a.gep:4",
+		"__response__.Write(__raw_gep_a_dgep_1)": "a.gep:3",
+		"__response__.Write(__raw_gep_a_dgep_2)": "a.gep:4",
+	}
+	poses := stmtLines(t, goSrc)
+	for code, pos := range expected {
+		if poses[code] != pos {
+			t.Errorf("Expected %s at %s, but got %q", code, pos, poses[code])
+		}
+	}
+}
+
+func TestGenGoSource_split(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_gen_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	// one-line code parts split into lines by gofmt
+	goSrc := genTestSource(t, root, "err.gep", "<% c := true %>\n<% x := 1; y := x %>\n<% _ = y %>\n"+
+		"<% if c { var m map[string]int; m[\"a\"] = 1 } %>\n<% z := 2 %>\n")
+	expected := map[string]string{
+		"y := x":               "err.gep:2",
+		"_ = y":                "err.gep:3",
+		"if c {":               "err.gep:4",
+		"var m map[string]int": "err.gep:4",
+		`m["a"] = 1`:           "err.gep:4",
+		"z := 2":               "err.gep:5",
+		"__response__.Write(__raw_gep_err_dgep_4)": "err.gep:5",
+	}
+	poses := stmtLines(t, goSrc)
+	for code, pos := range expected {
+		if poses[code] != pos {
+			t.Errorf("Expected %s at %s, but got %q\n%s", code, pos, poses[code], goSrc)
+		}
+	}
+}
+
+func TestGenGoSource_templateError(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_gen_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+	root.Join("a.gep").WriteFile([]byte("<h1>a</h1>"), 0666)
+	sg := sourceGenerator{m: &monitor{webDir: root}}
+	parts, err := gep.ParseFile(&sg, "a.gep")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(tmpl *template.Template) { sTemplate = tmpl }(sTemplate)
+	sTemplate = template.Must(template.New("page").Parse("package main\n{{.Missing}}"))
+	if goSrc, err := genGoSource(parts, "a.gep", srcName("a.gep"), nil); err == nil {
+		t.Errorf("Expected an error of the template, but got %q", goSrc)
+	}
+}
+
+func TestGenCommand(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_gen_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+	root = root.AbsPath()
+	web := root.Join("web")
+	web.MkdirAll(0777)
+	web.Join("index.gep").WriteFile([]byte("<p>hi</p>"), 0666)
+	web.Join("inc.gep").WriteFile([]byte("<%!includeonly%>x"), 0666)
+
+	defer func(paths struct {
+		webRoot            villa.Path
+		src, exe, tmp, inc villa.Path
+		lib                villa.Path
+	}) {
+		gPaths = paths
+	}(gPaths)
+	gPaths.webRoot, gPaths.inc, gPaths.lib = web, "", ""
+
+	dir := root.Join("gen")
+	if code := genCommand([]string{dir.S()}); code != 0 {
+		t.Fatalf("Expected exit code 0, but got %d", code)
+	}
+	for _, fn := range []string{"gep_index_dgep.go", fn_GEPSVR_GO, fn_GO_MOD} {
+		if !dir.Join(fn).Exists() {
+			t.Errorf("Expected %s generated", fn)
+		}
+	}
+	if dir.Join("gep_inc_dgep.go").Exists() {
+		t.Errorf("Expected no source of an include-only file")
+	}
+}
+
+func TestMiddlewaresOf(t *testing.T) {
+	urls := villa.NewStrSet("_middleware.gep", "admin/_middleware.gep", "admin/x/_middleware.gep")
+	cases := []struct {
+		url string
+		mws []string
+	}{
+		{"index.gep", []string{"_middleware.gep"}},
+		{"admin/x/y.gep", []string{"_middleware.gep", "admin/_middleware.gep", "admin/x/_middleware.gep"}},
+		{"admins/a.gep", []string{"_middleware.gep"}},
+	}
+	for _, c := range cases {
+		if mws := middlewaresOf(c.url, urls); !reflect.DeepEqual(mws, c.mws) {
+			t.Errorf("middlewaresOf(%q): expected %v, but got %v", c.url, c.mws, mws)
+		}
+	}
+}
+
+func TestIsHook(t *testing.T) {
+	for url, hook := range map[string]bool{
+		"_app.gep":              true,
+		"_middleware.gep":       true,
+		"admin/_middleware.gep": true,
+		"admin/_app.gep":        false,
+		"index.gep":             false,
+		"admin/users.gep":       false,
+	} {
+		if isHook(url) != hook {
+			t.Errorf("isHook(%q): expected %v", url, hook)
+		}
+	}
+}
+
+func TestLibName(t *testing.T) {
+	cases := []struct{ rel, name string }{
+		{"util.go", "lib_util.go"},
+		{"db/Conn.go", "lib_db_s_uconn.go"},
+		{"util_test.go", "lib_util_test.go"},
+	}
+	for _, c := range cases {
+		if name := libName(villa.Path(c.rel)); name != c.name {
+			t.Errorf("libName(%q): expected %q, but got %q", c.rel, c.name, name)
+		}
+	}
+}
+
+func TestCopyLibFiles(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_lib_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	web, out := root.Join("web"), root.Join("out")
+	web.Join("db").MkdirAll(0777)
+	out.MkdirAll(0777)
+	files := map[string]string{
+		"app.go":        "package main\n\nfunc OnStart(app *App) error { return nil }\n",
+		"db/db.go":      "package main\n\nfunc OnStop(app *App) error { return nil }\n",
+		"app_test.go":   "package main\n",
+		"index.gep":     "",
+		"db/readme.txt": "",
+		// not in the package, like the go tool
+		"vendor/example.com/dep/dep.go": "package dep\n",
+		"vendor/modules.txt":            "# example.com/dep v1.0.0\n",
+		"testdata/x.go":                 "package x\n",
+		".git/x.go":                     "package x\n",
+		"_old/x.go":                     "package x\n",
+	}
+	for fn, src := range files {
+		web.Join(fn).Dir().MkdirAll(0777)
+		if err := web.Join(fn).WriteFile([]byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := &monitor{webDir: web}
+	if libFiles := m.scanLibFiles(false); len(libFiles) != 2 {
+		t.Errorf("Expected 2 .go files, but got %v", libFiles)
+	}
+	if _, err := m.copyLibFiles(m.scanLibFiles(true), out); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"lib_app.go", "lib_db_sdb.go", "lib_app_test.go"} {
+		if _, err := out.Join(fn).Stat(); err != nil {
+			t.Errorf("Expected %s copied: %v", fn, err)
+		}
+	}
+	hooks, err := out.Join(fn_HOOKS_GO).ReadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(hooks), "registerApp(OnStart)") ||
+		!strings.Contains(string(hooks), "theApp.OnStop(OnStop)") {
+		t.Errorf("Unexpected hooks:\n%s", hooks)
+	}
+}
+
+func TestParse_incremental(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_inc_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	web, src := root.Join("web"), root.Join("src")
+	web.MkdirAll(0777)
+	src.MkdirAll(0777)
+	files := map[string]string{
+		"a.gep":      `<%!include "header.gep"%>a`,
+		"b.gep":      `b`,
+		"header.gep": `<%!includeonly%>header`,
+	}
+	for fn, s := range files {
+		if err := web.Join(fn).WriteFile([]byte(s), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := &monitor{webDir: web, srcDir: src}
+	if err := m.parse(srcNames(m.scanFiles())); err != nil {
+		t.Fatal(err)
+	}
+	// mark generated files old to see which are rewritten
+	old := time.Now().Add(-time.Hour)
+	for _, fn := range []string{"gep_a_dgep.go", "gep_b_dgep.go"} {
+		os.Chtimes(src.Join(fn).S(), old, old)
+	}
+
+	web.Join("header.gep").WriteFile([]byte(`<%!includeonly%>new header`), 0666)
+	srcFiles := srcNames(m.scanFiles())
+	if err := m.parse(srcFiles); err != nil {
+		t.Fatal(err)
+	}
+	if len(srcFiles) != 2 {
+		t.Errorf("Expected includeonly file removed, but got %v", srcFiles)
+	}
+	a, _ := src.Join("gep_a_dgep.go").ReadFile()
+	if !strings.Contains(string(a), "new header") {
+		t.Errorf("Expected a.gep regenerated, but got\n%s", a)
+	}
+	if info, _ := src.Join("gep_b_dgep.go").Stat(); !info.ModTime().Equal(old) {
+		t.Errorf("Expected gep_b_dgep.go left alone, but modified at %v", info.ModTime())
+	}
+}
+
+func TestParse_missingInclude(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_inc_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	web, src := root.Join("web"), root.Join("src")
+	web.MkdirAll(0777)
+	src.MkdirAll(0777)
+	web.Join("a.gep").WriteFile([]byte(`a<%!include "b.inc"%>`), 0666)
+
+	m := &monitor{webDir: web, srcDir: src}
+	if err := m.parse(srcNames(m.scanFiles())); err != nil {
+		t.Fatal(err)
+	}
+	// still missing
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(src.Join("gep_a_dgep.go").S(), old, old)
+	if err := m.parse(srcNames(m.scanFiles())); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := src.Join("gep_a_dgep.go").Stat(); !info.ModTime().Equal(old) {
+		t.Errorf("Expected gep_a_dgep.go left alone, but modified at %v", info.ModTime())
+	}
+
+	web.Join("b.inc").WriteFile([]byte(`included b`), 0666)
+	if err := m.parse(srcNames(m.scanFiles())); err != nil {
+		t.Fatal(err)
+	}
+	a, _ := src.Join("gep_a_dgep.go").ReadFile()
+	if !strings.Contains(string(a), "included b") {
+		t.Errorf("Expected a.gep parsed again with the include created, but got\n%s", a)
+	}
+}
+
+func TestParse_stale(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_stale_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	web, src := root.Join("web"), root.Join("src")
+	web.MkdirAll(0777)
+	src.MkdirAll(0777)
+	web.Join("a.gep").WriteFile([]byte(`a`), 0666)
+	web.Join("b.gep").WriteFile([]byte(`b`), 0666)
+	src.Join("notes.go").WriteFile([]byte(`package main`), 0666)
+
+	m := &monitor{webDir: web, srcDir: src}
+	if err := m.parse(srcNames(m.scanFiles())); err != nil {
+		t.Fatal(err)
+	}
+
+	web.Join("a.gep").WriteFile([]byte(`<%!includeonly%>a`), 0666)
+	web.Join("b.gep").Remove()
+	if err := m.parse(srcNames(m.scanFiles())); err != nil {
+		t.Fatal(err)
+	}
+	for _, fn := range []string{"gep_a_dgep.go", "gep_b_dgep.go"} {
+		if _, err := src.Join(fn).Stat(); err == nil {
+			t.Errorf("Expected stale %s removed", fn)
+		}
+	}
+	if _, err := src.Join("notes.go").Stat(); err != nil {
+		t.Errorf("Expected notes.go kept: %v", err)
+	}
+}
+
+func TestRemoveOldTempDirs(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_tmp_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	m := &monitor{webDir: "/site/web", tmpRoot: root}
+	current := filepath.Base(m.buildDir().S())
+	now := time.Now()
+	// the current build folder is the oldest, geps_build_c the newest
+	for i, name := range []string{current, "geps_build_a", "gep_test_1", "geps_build_b", "geps_build_c", "other"} {
+		dir := root.Join(name)
+		dir.MkdirAll(0777)
+		mtime := now.Add(time.Duration(i-10) * time.Minute)
+		os.Chtimes(dir.S(), mtime, mtime)
+	}
+
+	defer func(keep int) { gKeepTempDirs = keep }(gKeepTempDirs)
+	gKeepTempDirs = 3
+	if err := m.removeOldTempDirs(); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := root.ReadDir()
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	exp := []string{current, "geps_build_b", "geps_build_c", "other"}
+	sort.Strings(names)
+	sort.Strings(exp)
+	if !reflect.DeepEqual(names, exp) {
+		t.Errorf("Expected %v left, but got %v", exp, names)
+	}
+}
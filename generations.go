@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/daviddengcn/go-villa"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// folder in code.exe keeping the generations
+const fn_GENERATIONS = "generations"
+
+// Number of successful builds kept as generations for rolling back
+var gKeepGenerations = 5
+
+// ID of the generation serving, 0 if unknown
+var gLiveGeneration villa.AtomicBox
+
+var errNoGeneration = errors.New("generation not found")
+
+// generation is a successful build kept for rolling back without
+// recompiling. Its executable and input manifest are kept as
+// gen-<id>.exe(.manifest), described by gen-<id>.json.
+type generation struct {
+	ID   int       `json:"id"`
+	Time time.Time `json:"time"`
+	// SHA-256 of the input manifest
+	Inputs string `json:"inputs"`
+	// urls of pages built
+	Pages []string `json:"pages"`
+	// urls of pages left out by a partial build
+	Broken []string `json:"broken,omitempty"`
+}
+
+func (g *generation) name() string {
+	return fmt.Sprintf("gen-%d", g.ID)
+}
+
+func (g *generation) exeFile(dir villa.Path) villa.Path {
+	return dir.Join(g.name() + ".exe")
+}
+
+// loadGenerations returns the generations kept in dir, oldest first
+func loadGenerations(dir villa.Path) ([]*generation, error) {
+	infos, err := dir.ReadDir()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var gens []*generation
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, "gen-") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := dir.Join(name).ReadFile()
+		if err != nil {
+			return nil, err
+		}
+		g := &generation{}
+		if err := json.Unmarshal(data, g); err != nil {
+			log.Println("Reading generation", name, "failed:", err)
+			continue
+		}
+		gens = append(gens, g)
+	}
+	sort.Slice(gens, func(i, j int) bool {
+		return gens[i].ID < gens[j].ID
+	})
+	return gens, nil
+}
+
+// findGeneration returns the generation of id in dir
+func findGeneration(dir villa.Path, id int) (*generation, error) {
+	gens, err := loadGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gens {
+		if g.ID == id {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %d", errNoGeneration, id)
+}
+
+// matchGeneration returns the ID of the newest generation in dir built from
+// inputs, 0 if none.
+func matchGeneration(dir villa.Path, inputs manifest) int {
+	if inputs == nil {
+		return 0
+	}
+	gens, _ := loadGenerations(dir)
+	hash := inputs.hash()
+	for i := len(gens) - 1; i >= 0; i-- {
+		if gens[i].Inputs == hash {
+			return gens[i].ID
+		}
+	}
+	return 0
+}
+
+// copyExe copies an executable file. dst is removed first in case it is
+// running.
+func copyExe(src, dst villa.Path) error {
+	data, err := src.ReadFile()
+	if err != nil {
+		return err
+	}
+	dst.Remove()
+	return dst.WriteFile(data, 0777)
+}
+
+// archiveGeneration keeps the executable exe and its manifest in dir as a
+// new generation with the pages built and left out, and removes generations
+// except the newest keep ones.
+func archiveGeneration(dir, exe villa.Path, pages []string, broken map[string][]buildError, keep int) (*generation, error) {
+	if err := dir.MkdirAll(0777); err != nil {
+		return nil, err
+	}
+	gens, err := loadGenerations(dir)
+	if err != nil {
+		return nil, err
+	}
+	g := &generation{
+		ID:     1,
+		Time:   time.Now(),
+		Inputs: loadManifest(exe + s_MANIFEST_SUFFIX).hash(),
+		Pages:  pages,
+	}
+	if len(gens) > 0 {
+		g.ID = gens[len(gens)-1].ID + 1
+	}
+	for page := range broken {
+		g.Broken = append(g.Broken, page)
+	}
+	sort.Strings(g.Broken)
+
+	if err := copyExe(exe, g.exeFile(dir)); err != nil {
+		return nil, err
+	}
+	if err := copyFile(exe+s_MANIFEST_SUFFIX, g.exeFile(dir)+s_MANIFEST_SUFFIX); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// the description last, so a generation half written is not listed
+	if err := dir.Join(g.name()+".json").WriteFile(data, 0666); err != nil {
+		return nil, err
+	}
+
+	gens = append(gens, g)
+	if len(gens) > keep {
+		for _, old := range gens[:len(gens)-keep] {
+			if err := old.remove(dir); err != nil {
+				return g, err
+			}
+		}
+	}
+	return g, nil
+}
+
+// remove deletes the files of the generation in dir
+func (g *generation) remove(dir villa.Path) error {
+	log.Println("Removing old generation:", g.name())
+	// the description first, so a generation half removed is not listed
+	for _, path := range []villa.Path{dir.Join(g.name() + ".json"),
+		g.exeFile(dir), g.exeFile(dir) + s_MANIFEST_SUFFIX} {
+		if err := path.Remove(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// restore copies the executable and the manifest of the generation in dir to
+// exe.
+func (g *generation) restore(dir, exe villa.Path) error {
+	if err := copyExe(g.exeFile(dir), exe); err != nil {
+		return err
+	}
+	return copyFile(g.exeFile(dir)+s_MANIFEST_SUFFIX, exe+s_MANIFEST_SUFFIX)
+}
+
+// rollbackRequest asks the compiling loop to switch to the generation of id,
+// the result is sent back to result.
+type rollbackRequest struct {
+	id     int
+	result chan error
+}
+
+// Rolling back requests to the compiling loop
+var gRollbacks = make(chan rollbackRequest)
+
+// header required by POST /__geps/rollback. Browsers do not send it in
+// cross-site requests without a CORS preflight, which is never allowed.
+const s_ROLLBACK_HEADER = "X-Geps-Rollback"
+
+// isCrossSite returns true if r is sent by a page of another origin, or
+// lacks the rollback header.
+func isCrossSite(r *http.Request) bool {
+	if r.Header.Get(s_ROLLBACK_HEADER) == "" {
+		return true
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	u, err := url.Parse(origin)
+	return err != nil || u.Host != r.Host
+}
+
+// handleGenerations lists the generations kept in JSON, and the serving one.
+// Only local requests are allowed.
+func handleGenerations(w http.ResponseWriter, r *http.Request) {
+	if !isLoopback(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	gens, err := loadGenerations(gPaths.exe.Join(fn_GENERATIONS))
+	if err != nil {
+		log.Println("Loading generations:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	live, _ := gLiveGeneration.Get().(int)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(struct {
+		Live        int           `json:"live"`
+		Generations []*generation `json:"generations"`
+	}{live, gens})
+}
+
+// handleRollback switches the traffic to the generation in the "gen"
+// parameter of a POST request, without recompiling. Only local requests
+// with the X-Geps-Rollback header and no foreign Origin are allowed.
+func handleRollback(w http.ResponseWriter, r *http.Request) {
+	if !isLoopback(r) || isCrossSite(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("gen"))
+	if err != nil {
+		http.Error(w, "invalid generation: "+r.FormValue("gen"), http.StatusBadRequest)
+		return
+	}
+
+	req := rollbackRequest{id: id, result: make(chan error, 1)}
+	select {
+	case gRollbacks <- req:
+	case <-r.Context().Done():
+		return
+	}
+	if err := <-req.result; err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNoGeneration) {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	back, _ := backHost.Get().(string)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		Live int    `json:"live"`
+		Back string `json:"back"`
+	}{id, back})
+}
+
+// generationsCommand implements "geps generations", listing the generations
+// kept.
+func generationsCommand(args []string) int {
+	gens, err := loadGenerations(gPaths.exe.Join(fn_GENERATIONS))
+	if err != nil {
+		log.Println("Loading generations failed:", err)
+		return 1
+	}
+	for _, g := range gens {
+		inputs := g.Inputs
+		if len(inputs) > 12 {
+			inputs = inputs[:12]
+		}
+		fmt.Printf("%5d  %s  %s  %d pages", g.ID, g.Time.Format("2006-01-02 15:04:05"), inputs, len(g.Pages))
+		if len(g.Broken) > 0 {
+			fmt.Printf(", %d left out", len(g.Broken))
+		}
+		fmt.Println()
+	}
+	return 0
+}
+
+// rollbackCommand implements "geps rollback <id> [addr]". It asks the
+// running daemon at addr, listen.addr by default, to switch to a generation.
+func rollbackCommand(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: geps rollback <generation> [addr]")
+		return 2
+	}
+	addr := gConf.String("listen.addr", ":8080")
+	if len(args) > 1 {
+		addr = args[1]
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Println("Invalid listen.addr:", err)
+		return 1
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	req, err := http.NewRequest("POST", "http://"+net.JoinHostPort(host, port)+"/__geps/rollback",
+		strings.NewReader(url.Values{"gen": {args[0]}}.Encode()))
+	if err != nil {
+		log.Println("Rolling back failed:", err)
+		return 1
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(s_ROLLBACK_HEADER, "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Println("Rolling back failed:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Rolling back failed: %s %s", resp.Status, strings.TrimSpace(string(body)))
+		return 1
+	}
+	log.Println("Rolled back:", strings.TrimSpace(string(body)))
+	return 0
+}
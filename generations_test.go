@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/daviddengcn/go-villa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestArchiveGeneration(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_generations_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+	dir := root.Join(fn_GENERATIONS)
+	exe := root.Join("gepsvr-1.exe")
+
+	for i := 1; i <= 3; i++ {
+		exe.WriteFile([]byte(fmt.Sprintf("exe %d", i)), 0777)
+		mf := manifest{"/web/a.gep": {Size: int64(i), SHA256: "aa"}}
+		mf.save(exe + s_MANIFEST_SUFFIX)
+		broken := map[string][]buildError{"/c.gep": nil}
+		g, err := archiveGeneration(dir, exe, []string{"/a.gep", "/b.gep"}, broken, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.ID != i || g.Inputs != mf.hash() || len(g.Pages) != 2 || len(g.Broken) != 1 {
+			t.Errorf("Unexpected generation: %+v", g)
+		}
+	}
+
+	gens, err := loadGenerations(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != 2 || gens[0].ID != 2 || gens[1].ID != 3 {
+		t.Fatalf("Expected generations 2 and 3 kept, but got %+v", gens)
+	}
+	if root.Join(fn_GENERATIONS, "gen-1.exe").Exists() {
+		t.Errorf("Expected the executable of gen-1 removed")
+	}
+	if _, err := findGeneration(dir, 1); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected gen-1 not found, but got %v", err)
+	}
+
+	g, err := findGeneration(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := root.Join("gepsvr-2.exe")
+	if err := g.restore(dir, target); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := target.ReadFile(); string(data) != "exe 2" {
+		t.Errorf("Expected the executable of gen-2 restored, but got %q", data)
+	}
+	if id := matchGeneration(dir, loadManifest(target+s_MANIFEST_SUFFIX)); id != 2 {
+		t.Errorf("Expected the manifest of gen-2 matched, but got %d", id)
+	}
+	if id := matchGeneration(dir, manifest{}); id != 0 {
+		t.Errorf("Expected no generation matched, but got %d", id)
+	}
+}
+
+func TestHandleRollback(t *testing.T) {
+	post := func(gen string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/__geps/rollback", strings.NewReader(url.Values{"gen": {gen}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set(s_ROLLBACK_HEADER, "1")
+		req.RemoteAddr = "127.0.0.1:12345"
+		rec := httptest.NewRecorder()
+		handleRollback(rec, req)
+		return rec
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case req := <-gRollbacks:
+				if req.id == 2 {
+					req.result <- nil
+				} else {
+					req.result <- fmt.Errorf("%w: %d", errNoGeneration, req.id)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	if rec := post("2"); rec.Code != http.StatusOK {
+		t.Errorf("Expected OK, but got %d %s", rec.Code, rec.Body)
+	} else {
+		var resp struct{ Live int }
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if resp.Live != 2 {
+			t.Errorf("Expected live generation 2, but got %s", rec.Body)
+		}
+	}
+	if rec := post("7"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected %d for a missing generation, but got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := post("x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected %d for an invalid generation, but got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/__geps/rollback?gen=2", nil)
+	req.Header.Set(s_ROLLBACK_HEADER, "1")
+	req.RemoteAddr = "127.0.0.1:12345"
+	rec := httptest.NewRecorder()
+	handleRollback(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d for GET, but got %d", http.StatusMethodNotAllowed, rec.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/__geps/rollback?gen=2", nil)
+	req.Header.Set(s_ROLLBACK_HEADER, "1")
+	req.RemoteAddr = "10.0.0.1:12345"
+	rec = httptest.NewRecorder()
+	handleRollback(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected %d for a remote request, but got %d", http.StatusForbidden, rec.Code)
+	}
+
+	// a form posted by a page in the browser
+	req = httptest.NewRequest("POST", "/__geps/rollback?gen=2", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	rec = httptest.NewRecorder()
+	handleRollback(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected %d without the header, but got %d", http.StatusForbidden, rec.Code)
+	}
+	req.Header.Set(s_ROLLBACK_HEADER, "1")
+	req.Header.Set("Origin", "http://evil.example")
+	rec = httptest.NewRecorder()
+	handleRollback(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected %d for a foreign origin, but got %d", http.StatusForbidden, rec.Code)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 // GepParts is the data-structure for parsed results
@@ -22,6 +23,48 @@ type GepParts struct {
 
 	// Whether the root source is marked as includeonly
 	IncludeOnly bool
+	// Bytes of output buffered before streaming, -1 if not specified
+	Buffer int
+	// Mode of the page set by <%!page mode%>, e.g. "api" for JSON API pages
+	Mode string
+
+	// Positions of the parts, one for each element in Parts
+	Poses []Pos
+	// Positions of the first import primitive of each package
+	ImportPoses map[string]Pos
+	// Positions of the first include/require primitive of each path
+	DependPoses map[string]Pos
+	// All required paths
+	Requires villa.StrSet
+}
+
+// Pos is a position in a source file
+type Pos struct {
+	// Path of the file. Empty for the root source of Parse.
+	File string
+	// Line and column(in bytes), both starting from 1
+	Line, Col int
+}
+
+// String returns the position in the form of file:line:col
+func (pos Pos) String() string {
+	s := fmt.Sprintf("%d:%d", pos.Line, pos.Col)
+	if pos.File != "" {
+		s = pos.File + ":" + s
+	}
+	return s
+}
+
+// Advance returns the position after the text of src, which starts at pos.
+func (pos Pos) Advance(src string) Pos {
+	for i := 0; i < len(src); i++ {
+		if src[i] == '\n' {
+			pos.Line, pos.Col = pos.Line+1, 1
+		} else {
+			pos.Col++
+		}
+	}
+	return pos
 }
 
 // Interface defines some actions for parsing
@@ -45,8 +88,25 @@ type Interface interface {
 
 // Parse parses the source with a predefined Interface.
 func Parse(f Interface, src string) (parts *GepParts, err error) {
-	p := &parser{Interface: f, GepParts: &GepParts{}}
-	err = p.parse(src)
+	p := &parser{Interface: f, GepParts: &GepParts{Buffer: -1}}
+	err = p.parse(src, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return p.GepParts, nil
+}
+
+// ParseFile loads the source of path with f and parses it. Positions in the
+// root source are reported with path as the file.
+func ParseFile(f Interface, path villa.Path) (parts *GepParts, err error) {
+	src, err := f.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{Interface: f, GepParts: &GepParts{Buffer: -1}}
+	err = p.parse(src, path.S())
 	if err != nil {
 		return nil, err
 	}
@@ -74,11 +134,12 @@ const (
 )
 
 // Add raw code (between <% and %>)
-func (p *parser) addRaw(src string) {
+func (p *parser) addRaw(src string, pos Pos) {
 	if len(src) == 0 {
 		return
 	} // if
 	p.Parts = append(p.Parts, p.GenRawPart(src))
+	p.Poses = append(p.Poses, pos)
 }
 
 // seperates "import xx xx" into "import", "xxx xxx"
@@ -95,8 +156,14 @@ func sepGlobal(src string) (cmd, remain string) {
 }
 
 // includes a file
-func (p *parser) include(path villa.Path) error {
+func (p *parser) include(path villa.Path, pos Pos) error {
 	p.Depends.Put(path.S())
+	if _, ok := p.DependPoses[path.S()]; !ok {
+		if p.DependPoses == nil {
+			p.DependPoses = make(map[string]Pos)
+		}
+		p.DependPoses[path.S()] = pos
+	}
 	src, err := p.Load(path)
 
 	if err != nil {
@@ -104,20 +171,22 @@ func (p *parser) include(path villa.Path) error {
 	}
 
 	p.includeStack.Add(path)
-	p.parse(src)
+	p.parse(src, path.S())
 	p.includeStack.Pop()
 
 	return nil
 }
 
 // appends some code
-func (p *parser) addCode(src string, codeType int) {
+func (p *parser) addCode(src string, codeType int, pos Pos) {
 	switch codeType {
 	case ct_LOCAL:
 		p.Parts.Add(p.GenCodePart(src))
+		p.Poses = append(p.Poses, pos)
 
 	case ct_EVAL:
 		p.Parts.Add(p.GenEvalPart(src))
+		p.Poses = append(p.Poses, pos)
 
 	case ct_IGNORE:
 		// Do nothing
@@ -131,6 +200,12 @@ func (p *parser) addCode(src string, codeType int) {
 				impstr, err := strconv.Unquote(strings.TrimSpace(imp))
 				if err == nil {
 					p.Imports.Put(impstr)
+					if _, ok := p.ImportPoses[impstr]; !ok {
+						if p.ImportPoses == nil {
+							p.ImportPoses = make(map[string]Pos)
+						}
+						p.ImportPoses[impstr] = pos
+					}
 				} else {
 					p.Error(fmt.Sprintf("import %s error: %v", imp, err))
 				}
@@ -143,7 +218,7 @@ func (p *parser) addCode(src string, codeType int) {
 				if !p.included.In(inc) {
 					p.included.Put(inc)
 					p.required.Put(inc)
-					err = p.include(villa.Path(inc))
+					err = p.include(villa.Path(inc), pos)
 					if err != nil {
 						p.Error(fmt.Sprintf("include %s failed: %v", inc, err))
 					}
@@ -157,9 +232,10 @@ func (p *parser) addCode(src string, codeType int) {
 			imp := strings.TrimSpace(src)
 			inc, err := strconv.Unquote(imp)
 			if err == nil {
+				p.Requires.Put(inc)
 				if !p.required.In(inc) {
 					p.required.Put(inc)
-					err = p.include(villa.Path(inc))
+					err = p.include(villa.Path(inc), pos)
 					if err != nil {
 						p.Error(fmt.Sprintf("require %s failed: %v", inc, err))
 					}
@@ -174,14 +250,27 @@ func (p *parser) addCode(src string, codeType int) {
 				p.IncludeOnly = true
 			}
 
+		case "page":
+			p.Mode = strings.TrimSpace(src)
+
+		case "buffer":
+			size, err := strconv.Atoi(strings.TrimSpace(src))
+			if err == nil && size < 0 {
+				p.Error(fmt.Sprintf("buffer %s error: negative size", src))
+			} else if err == nil {
+				p.Buffer = size
+			} else {
+				p.Error(fmt.Sprintf("buffer %s error: %v", src, err))
+			}
+
 		default:
 			p.Error(fmt.Sprintf("Unknown command %s, ignored!", cmd))
 		}
 	}
 }
 
-// parses source
-func (p *parser) parse(src string) (err error) {
+// parses source of file
+func (p *parser) parse(src string, file string) (err error) {
 	/*
 		Status Transition
 
@@ -209,7 +298,16 @@ func (p *parser) parse(src string) (err error) {
 	)
 	status, tp := R, ct_GLOBAL
 	var source bytes.Buffer
+	// cur is the position next to r, start is the position of source
+	cur := Pos{File: file, Line: 1, Col: 1}
+	start := cur
 	for _, r := range src {
+		if r == '\n' {
+			cur.Line, cur.Col = cur.Line+1, 1
+		} else {
+			cur.Col += utf8.RuneLen(r)
+		}
+
 		switch status {
 		case R:
 			switch r {
@@ -223,8 +321,9 @@ func (p *parser) parse(src string) (err error) {
 			switch r {
 			case '%':
 				status, tp = C1, ct_LOCAL
-				p.addRaw(source.String())
+				p.addRaw(source.String(), start)
 				source.Reset()
+				start = cur
 
 			default:
 				status = R
@@ -235,13 +334,13 @@ func (p *parser) parse(src string) (err error) {
 		case C1:
 			switch r {
 			case '=':
-				status, tp = C2, ct_EVAL
+				status, tp, start = C2, ct_EVAL, cur
 
 			case '!':
-				status, tp = C2, ct_GLOBAL
+				status, tp, start = C2, ct_GLOBAL, cur
 
 			case '#':
-				status, tp = C2, ct_IGNORE
+				status, tp, start = C2, ct_IGNORE, cur
 
 			case '%':
 				status = C3
@@ -264,8 +363,9 @@ func (p *parser) parse(src string) (err error) {
 			switch r {
 			case '>':
 				status = R
-				p.addCode(source.String(), tp)
+				p.addCode(source.String(), tp, start)
 				source.Reset()
+				start = cur
 
 			default:
 				status = C2
@@ -278,7 +378,7 @@ func (p *parser) parse(src string) (err error) {
 	switch status {
 	case R:
 		if source.Len() > 0 {
-			p.addRaw(source.String())
+			p.addRaw(source.String(), start)
 		}
 	default:
 		p.Error("Unclosed tag " + source.String())
@@ -136,3 +136,92 @@ func TestParser_includeonly(t *testing.T) {
 		t.Errorf("IncludeOnly is expected to be false")
 	}
 }
+
+func TestParseFile_poses(t *testing.T) {
+	f := simple{
+		"page":  "ab\n<%!require \"funcs\"%>\n  <%= play() %>",
+		"funcs": `<%!import "fmt"%><% play := func() string { return fmt.Sprint(1) } %>`}
+
+	parts, err := ParseFile(f, "page")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+
+	expectedPoses := []Pos{
+		{"page", 1, 1},
+		{"funcs", 1, 20},
+		{"page", 2, 21},
+		{"page", 3, 6},
+	}
+	if len(parts.Poses) != len(expectedPoses) {
+		t.Errorf("Expected poses: %v, but got %v", expectedPoses, parts.Poses)
+		return
+	}
+	for i, pos := range expectedPoses {
+		if parts.Poses[i] != pos {
+			t.Errorf("Poses[%d]: expected %v, but got %v", i, pos, parts.Poses[i])
+		}
+	}
+
+	if pos := parts.ImportPoses["fmt"]; pos != (Pos{"funcs", 1, 4}) {
+		t.Errorf("Expected import position funcs:1:4, but got %v", pos)
+	}
+	if pos := parts.DependPoses["funcs"]; pos != (Pos{"page", 2, 4}) {
+		t.Errorf("Expected depend position page:2:4, but got %v", pos)
+	}
+	if !parts.Requires.Equals(villa.NewStrSet("funcs")) {
+		t.Errorf("Expected requires: [funcs], but got %v", parts.Requires)
+	}
+}
+
+func TestPos_Advance(t *testing.T) {
+	pos := Pos{"a", 3, 5}.Advance("xy\nabc")
+	if pos != (Pos{"a", 4, 4}) {
+		t.Errorf("Expected a:4:4, but got %v", pos)
+	}
+}
+
+func TestParser_buffer(t *testing.T) {
+	f := simple{}
+	parts, err := Parse(f, "<%!buffer 1024 %>")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	if parts.Buffer != 1024 {
+		t.Errorf("Expected buffer 1024, but got %d", parts.Buffer)
+	}
+
+	parts, err = Parse(f, "abc")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	if parts.Buffer != -1 {
+		t.Errorf("Expected buffer -1, but got %d", parts.Buffer)
+	}
+
+	// 0 for no buffering, a negative size is an error and ignored
+	for src, size := range map[string]int{"<%!buffer 0 %>": 0, "<%!buffer -1 %>": -1} {
+		parts, err = Parse(f, src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parts.Buffer != size {
+			t.Errorf("%s: expected buffer %d, but got %d", src, size, parts.Buffer)
+		}
+	}
+}
+
+func TestParser_page(t *testing.T) {
+	f := simple{}
+	parts, err := Parse(f, "<%!page api %>")
+	if err != nil {
+		t.Errorf(err.Error())
+		return
+	}
+	if parts.Mode != "api" {
+		t.Errorf("Expected mode api, but got %q", parts.Mode)
+	}
+}
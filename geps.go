@@ -1,16 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/daviddengcn/go-ljson-conf"
 	"github.com/daviddengcn/go-villa"
+	"html/template"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -18,57 +26,275 @@ import (
 var backHost villa.AtomicBox
 
 var (
-	gWaitBeforeKill  time.Duration = 10
-	gWaitBeforeDel   time.Duration = 1
-	gWaitBeforeStart time.Duration = 1
+	gWaitBeforeKill time.Duration = 10
+	gStartTimeout   time.Duration = 30
+
+	// Restarts of a crashed back server before rolling back to the previous
+	// generation
+	gMaxRestarts = 3
+	// Maximum seconds between restarts of a crashed back server
+	gMaxBackoff time.Duration = 30
+	// A back server running longer than this is not crashing repeatedly
+	gStableTime = time.Minute
+
+	// Bytes of page output buffered before streaming
+	gPageBuffer = 64 << 10
+
+	// "dev" for development mode, "prod" otherwise
+	gMode = "prod"
 )
 
-func startBackServer(exeFile villa.Path, host string) (cmd *exec.Cmd) {
-	cmd = exeFile.Command(host)
+// backServer is a running back server process
+type backServer struct {
+	cmd *exec.Cmd
+	// closed when the process exits
+	done    chan struct{}
+	started time.Time
+	// last lines of stderr, logged if crashed
+	stderr *tailWriter
+}
+
+// tailWriter is an io.Writer keeping the last lines written
+type tailWriter struct {
+	mu      sync.Mutex
+	max     int
+	lines   []string
+	partial []byte
+}
+
+func (t *tailWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		i := bytes.IndexByte(t.partial, '\n')
+		if i < 0 {
+			break
+		}
+		t.lines = append(t.lines, string(t.partial[:i]))
+		t.partial = t.partial[i+1:]
+	}
+	if len(t.lines) > t.max {
+		t.lines = append([]string(nil), t.lines[len(t.lines)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// Lines returns the last lines written, including an unfinished one
+func (t *tailWriter) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lines := append([]string(nil), t.lines...)
+	if len(t.partial) > 0 {
+		lines = append(lines, string(t.partial))
+	}
+	return lines
+}
+
+// restartDelay returns the delay before restarting a back server crashed
+// for the n-th time in a row, doubled each time up to back.maxbackoff.
+func restartDelay(n int) time.Duration {
+	d := time.Second
+	for i := 1; i < n && d < gMaxBackoff*time.Second; i++ {
+		d *= 2
+	}
+	if d > gMaxBackoff*time.Second {
+		d = gMaxBackoff * time.Second
+	}
+	return d
+}
+
+// exited returns true if the process has exited
+func (s *backServer) exited() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Milliseconds between two readiness checks of a starting back server
+var gReadyInterval time.Duration = 100
+
+// readyClient is the client of readiness checks
+var readyClient = http.Client{Timeout: time.Second}
+
+// checkReady returns nil if the back server at host reports ready with pid
+func checkReady(host string, pid int) error {
+	resp, err := readyClient.Get("http://" + host + "/__geps/health")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	var health struct {
+		Pid int `json:"pid"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return err
+	}
+	if health.Pid != pid {
+		return fmt.Errorf("pid %d, expected %d", health.Pid, pid)
+	}
+	return nil
+}
+
+// waitReady polls the back server at host until it reports ready with pid.
+// An error is returned if done is closed, i.e. the process exited, or not
+// ready before timeout.
+func waitReady(host string, pid int, done <-chan struct{}, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		err := checkReady(host, pid)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-done:
+			return errors.New("exited while starting")
+		case <-deadline:
+			return fmt.Errorf("not ready in %v: %v", timeout, err)
+		case <-time.After(gReadyInterval * time.Millisecond):
+		}
+	}
+}
+
+// startBackServer starts a back server and waits for it ready. A
+// *startFailure is returned if it fails starting, e.g. the OnStart hook of
+// _app.gep fails, or is not ready in back.starttimeout seconds.
+func startBackServer(exeFile villa.Path, host string) (*backServer, error) {
+	cmd := exeFile.Command(host)
 	cmd.Dir = gPaths.webRoot.S()
+	cmd.Env = append(os.Environ(), "GEPS_MODE="+gMode)
+	stderr := &tailWriter{max: 20}
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = io.MultiWriter(os.Stderr, stderr)
 	err := cmd.Start()
 	if err != nil {
-		return nil
+		log.Println("Starting back server", exeFile, "failed:", err)
+		return nil, &startFailure{err: err}
+	}
+	s := &backServer{cmd: cmd, done: make(chan struct{}), started: time.Now(), stderr: stderr}
+	go func() {
+		cmd.Wait()
+		close(s.done)
+	}()
+
+	log.Printf("Waiting for new back server %s ready...\n", host)
+	start := time.Now()
+	if err := waitReady(host, cmd.Process.Pid, s.done, gStartTimeout*time.Second); err != nil {
+		if s.exited() {
+			log.Printf("Back server %s %v: %v", host, err, cmd.ProcessState)
+			return nil, &startFailure{err: fmt.Errorf("%v: %v", err, cmd.ProcessState), stderr: stderr.Lines()}
+		}
+		log.Printf("Back server %s %v, killed", host, err)
+		cmd.Process.Kill()
+		<-s.done
+		return nil, &startFailure{err: err, stderr: stderr.Lines()}
+	}
+	log.Printf("Back server %s ready in %v", host, time.Since(start))
+
+	return s, nil
+}
+
+// startFailed sets the build status to the failure of starting a new back
+// server. The old one keeps serving.
+func startFailed(err error) {
+	gBuildStatus.Set(&buildStatus{Time: time.Now(), Errors: errorsOf(err)})
+}
+
+// inflight counts requests in progress on back servers, by hosts
+type inflight struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// Requests in progress on back servers
+var gInflight inflight
+
+// acquire returns the host of the current back server, and counts a request
+// on it until release. The host is read and counted atomically, so all
+// requests on a back server switched out are counted.
+func (f *inflight) acquire() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	host := backHost.Get().(string)
+	if f.counts == nil {
+		f.counts = make(map[string]int)
+	}
+	f.counts[host]++
+	return host
+}
+
+func (f *inflight) release(host string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.counts[host]--; f.counts[host] <= 0 {
+		delete(f.counts, host)
 	}
+}
 
-	log.Printf("Waiting %ds for new back server %s starting...\n", gWaitBeforeStart, host)
-	time.Sleep(gWaitBeforeStart * time.Second)
+func (f *inflight) count(host string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts[host]
+}
 
-	return cmd
+// wait waits until no requests are in progress on host, at most timeout.
+// It returns false if timeout.
+func (f *inflight) wait(host string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for f.count(host) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
 }
 
-func killBackServer(cmd *exec.Cmd, exeFile villa.Path, lock *sync.Mutex) {
+// killBackServer stops an outdated back server at host, after its requests
+// in progress are done. The process shuts down gracefully on SIGTERM, and
+// is killed if not stopped in back.killwait seconds since switched out, for
+// both steps.
+func killBackServer(s *backServer, exeFile villa.Path, host string, lock *sync.Mutex) {
 	// release to lock to allow the entry reused.
 	defer lock.Unlock()
 
-	log.Printf("Waiting %ds for old host processing current requests: %v", gWaitBeforeKill, exeFile)
-	time.Sleep(gWaitBeforeKill * time.Second)
-	err := cmd.Process.Kill()
+	deadline := time.Now().Add(gWaitBeforeKill * time.Second)
+	log.Printf("Waiting at most %ds for old host processing current requests: %v", gWaitBeforeKill, exeFile)
+	if !gInflight.wait(host, time.Until(deadline)) {
+		log.Printf("Requests in progress on old host after %ds: %d", gWaitBeforeKill, gInflight.count(host))
+	}
+	if s.exited() {
+		log.Printf("Old host already exited: %v, %s", s.cmd.ProcessState, exeFile)
+		return
+	}
+	// SIGTERM lets the back server finish requests and call OnStop hooks
+	err := s.cmd.Process.Signal(syscall.SIGTERM)
 	if err != nil {
-		log.Println("Error killing old back server:", err, exeFile)
+		log.Println("Error stopping old back server:", err, exeFile)
 	}
 
 	log.Println("Waiting for old host dying:", exeFile)
-	stat, err := cmd.Process.Wait()
-
-	log.Printf("Host killed(delete after %ds): %v, %s", gWaitBeforeDel, stat, exeFile)
-	time.Sleep(gWaitBeforeDel * time.Second)
-
-	log.Println("Deleting", exeFile)
-	err = exeFile.Remove()
-	if err != nil {
-		log.Println("Deleting", exeFile, "failed:", err)
-	} else {
-		log.Println(exeFile, "deleted!")
+	select {
+	case <-s.done:
+	case <-time.After(time.Until(deadline)):
+		log.Printf("Old host not stopped in %ds, killing: %v", gWaitBeforeKill, exeFile)
+		if err := s.cmd.Process.Kill(); err != nil {
+			log.Println("Error killing old back server:", err, exeFile)
+		}
+		<-s.done
 	}
+	// the executable is kept for rolling back, until the entry is reused
+	log.Printf("Host stopped: %v, %s", s.cmd.ProcessState, exeFile)
 }
 
 func compilingLoop() {
 	gWaitBeforeKill = time.Duration(gConf.Int("back.killwait", int(gWaitBeforeKill)))
-	gWaitBeforeDel = time.Duration(gConf.Int("back.delwait", int(gWaitBeforeDel)))
-	gWaitBeforeStart = time.Duration(gConf.Int("back.startwait", int(gWaitBeforeStart)))
 
 	backPorts := gConf.IntList("back.ports", []int{8081, 8082, 8083})
 	log.Println("Back ports:", backPorts)
@@ -85,6 +311,7 @@ func compilingLoop() {
 
 	gPaths.exe.MkdirAll(0777)
 	gPaths.tmp.MkdirAll(0777)
+	genDir := gPaths.exe.Join(fn_GENERATIONS)
 
 	for i := range entries {
 		entries[i].exePath = gPaths.exe.Join(fmt.Sprintf("gepsvr-%d.exe", (1 + i)))
@@ -92,40 +319,222 @@ func compilingLoop() {
 	}
 
 	current, last := 0, 0
-	m := newMonitor(gPaths.webRoot, gPaths.src, gPaths.inc, gPaths.tmp)
-	var cmd *exec.Cmd = nil
+	m := newMonitor(gPaths.webRoot, gPaths.src, gPaths.inc, gPaths.tmp, gPaths.lib)
+	m.confFile = villa.Path(confFile).AbsPath()
+	m.partial = gConf.Bool("code.partial", false)
+	m.dev = gMode == "dev"
+	if err := m.removeOldTempDirs(); err != nil {
+		log.Println("Removing old temporary folders:", err)
+	}
+	var cmd *backServer = nil
+	// whether entries[prev] holds the executable of the previous generation,
+	// for rolling back if the current one keeps crashing
+	prev, prevOK := 0, false
+	// consecutive crashes of the current back server, and the timer of
+	// restarting it
+	crashes, restart := 0, (<-chan time.Time)(nil)
 
 	m.updateCheckExeFiles(entries[last].exePath, entries[current].exePath)
-	for {
-		func() {
-			// lock the current entry, block if it is still waiting for killing
-			entries[current].Lock()
-			defer entries[current].Unlock()
-
-			if m.run() || cmd == nil {
-				// No server started yet, or a new back server ready
-				// try start a back server
-				newCmd := startBackServer(entries[current].exePath, entries[current].backHost)
-				if newCmd != nil {
-					// switch to new back server
-					backHost.Set(entries[current].backHost)
-
-					if cmd != nil {
-						// kill the outdated back server
-						entries[last].Lock()
-						go killBackServer(cmd, entries[last].exePath, &entries[last].Mutex)
-						cmd = nil
+
+	// switch to the back server s of entries[i]
+	switchTo := func(s *backServer, i int) {
+		backHost.Set(entries[i].backHost)
+		gEvents.broadcast(sseEvent{name: s_EVENT_SWITCHED, data: entries[i].backHost})
+		cmd, crashes, restart = s, 0, nil
+		last, current = i, (i+1)%rr_NUM
+		m.updateCheckExeFiles(entries[last].exePath, entries[current].exePath)
+		gLiveGeneration.Set(matchGeneration(genDir, m.built))
+	}
+
+	// replace the running back server with s of entries[current]
+	replace := func(s *backServer) {
+		// a crashed one is not a generation to roll back to
+		prevOK = cmd != nil && !cmd.exited()
+		if cmd != nil {
+			// kill the outdated back server
+			entries[last].Lock()
+			go killBackServer(cmd, entries[last].exePath, entries[last].backHost, &entries[last].Mutex)
+			prev = last
+		}
+		switchTo(s, current)
+	}
+
+	// build if changed and start a new back server
+	update := func() {
+		// lock the current entry, block if it is still waiting for killing
+		entries[current].Lock()
+		defer entries[current].Unlock()
+
+		built := m.run()
+		if built && current == prev {
+			// the executable of the previous generation is overwritten
+			prevOK = false
+		}
+		if built || cmd == nil {
+			// No server started yet, or a new back server ready
+			// try start a back server
+			newCmd, err := startBackServer(entries[current].exePath, entries[current].backHost)
+			if err != nil && built {
+				startFailed(err)
+			}
+			if newCmd != nil {
+				// switch to new back server
+				exeFile := entries[current].exePath
+				replace(newCmd)
+				if built && gKeepGenerations > 0 {
+					g, err := archiveGeneration(genDir, exeFile, m.pageURLs, m.broken, gKeepGenerations)
+					if err != nil {
+						log.Println("Keeping generation:", err)
+					}
+					if g != nil {
+						log.Println("Generation kept:", g.name())
+						gLiveGeneration.Set(g.ID)
 					}
+				}
+			}
+		}
+	}
 
-					cmd = newCmd
-					last, current = current, (current+1)%rr_NUM
-					m.updateCheckExeFiles(entries[last].exePath, entries[current].exePath)
+	// rollback switches to the generation of id without recompiling. The
+	// current inputs are not built until changed again.
+	rollback := func(id int) error {
+		g, err := findGeneration(genDir, id)
+		if err != nil {
+			return err
+		}
+		entries[current].Lock()
+		defer entries[current].Unlock()
+
+		log.Printf("Rolling back to %s", g.name())
+		if current == prev {
+			// the executable of the previous generation is overwritten
+			prevOK = false
+		}
+		if err := g.restore(genDir, entries[current].exePath); err != nil {
+			log.Println("Restoring generation:", err)
+			return err
+		}
+		s, err := startBackServer(entries[current].exePath, entries[current].backHost)
+		if err != nil {
+			return fmt.Errorf("%s: %v", g.name(), err)
+		}
+		replace(s)
+		gLiveGeneration.Set(g.ID)
+		m.hold()
+		return nil
+	}
+
+	// crashed restarts the current back server later, or rolls back to the
+	// previous generation if crashed too many times
+	crashed := func() {
+		crashes++
+		if crashes > gMaxRestarts && prevOK {
+			log.Printf("Crashed %d times, rolling back to %s", crashes, entries[prev].exePath)
+			// wait for the old process on the port stopped
+			entries[prev].Lock()
+			s, _ := startBackServer(entries[prev].exePath, entries[prev].backHost)
+			entries[prev].Unlock()
+			prevOK = false
+			if s != nil {
+				switchTo(s, prev)
+				return
+			}
+		}
+		delay := restartDelay(crashes)
+		log.Printf("Restarting %s in %v", entries[last].exePath, delay)
+		restart = time.After(delay)
+	}
+
+	batches := make(chan []string)
+	sendBatch := func(paths []string) {
+		batches <- paths
+	}
+
+	// watch the folders of sources, again after the configuration reloaded
+	var w watcher
+	watch := func() {
+		if w != nil {
+			w.Close()
+		}
+		watchDirs := []villa.Path{gPaths.webRoot}
+		if gPaths.lib != "" && gPaths.lib != gPaths.webRoot {
+			watchDirs = append(watchDirs, gPaths.lib)
+		}
+		if m.gepsvrFile != "" {
+			watchDirs = append(watchDirs, m.gepsvrFile.Dir())
+		}
+		w = newWatcher(watchDirs, gConf.Bool("watch.poll", false))
+		go watchChanges(w, gWatchDelay*time.Millisecond, sendBatch)
+	}
+	watch()
+	defer func() {
+		w.Close()
+	}()
+
+	// The configuration file is polled alone, its folder is usually the
+	// root of the site with the files built.
+	confWatcher := newPollWatcher([]villa.Path{m.confFile}, gPollInterval*time.Millisecond)
+	defer confWatcher.Close()
+	go watchChanges(confWatcher, gWatchDelay*time.Millisecond, sendBatch)
+
+	// reload applies the changed configuration file. The inputs include it,
+	// so the site is rebuilt by the next update.
+	reload := func() {
+		if err := reloadConf(); err != nil {
+			log.Println("Reloading configuration failed, keeping the old one:", err)
+			return
+		}
+		log.Println("Configuration reloaded:", m.confFile)
+		m.libDir = gPaths.lib
+		m.partial = gConf.Bool("code.partial", false)
+		// page.buffer changes the generated code of every page
+		m.pages = nil
+		watch()
+	}
+
+	for {
+		update()
+
+		var retry <-chan time.Time
+		var exited <-chan struct{}
+		if cmd == nil {
+			// no back server running, try again later even without changes
+			retry = time.After(1 * time.Second)
+		} else if restart == nil {
+			// supervise the current back server
+			exited = cmd.done
+		}
+		select {
+		case paths := <-batches:
+			log.Println("Files changed:", paths)
+			for _, path := range paths {
+				if path == m.confFile.S() {
+					reload()
+					break
 				}
-				time.Sleep(1 * time.Second)
+			}
+			broadcastCSS(gPaths.webRoot, paths)
+		case <-retry:
+		case req := <-gRollbacks:
+			req.result <- rollback(req.id)
+		case <-exited:
+			log.Printf("Back server %s exited unexpectedly: %v", entries[last].backHost, cmd.cmd.ProcessState)
+			for _, line := range cmd.stderr.Lines() {
+				log.Println("  stderr:", line)
+			}
+			if time.Since(cmd.started) > gStableTime {
+				crashes = 0
+			}
+			crashed()
+		case <-restart:
+			restart = nil
+			if s, _ := startBackServer(entries[last].exePath, entries[last].backHost); s != nil {
+				log.Println("Back server restarted:", entries[last].backHost)
+				cmd = s
 			} else {
-				time.Sleep(1 * time.Second)
+				crashed()
 			}
-		}()
+		}
 	}
 }
 
@@ -136,27 +545,144 @@ func startCompilingLoop() {
 
 var client http.Client
 
+// client of error pages of back servers. The built-in error page is used if
+// a back server does not render one in time.
+var errorPageClient = http.Client{Timeout: 5 * time.Second}
+
+// copyResponse copies the header and body of resp to w
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// isLoopback returns true if r comes from the local machine
+func isLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// handleStatus shows the status of the daemon in JSON: the current back
+// server and its generation, and the result of the last build, including
+// pages left out of a partial build. Only local requests are allowed.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !isLoopback(r) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	status, _ := gBuildStatus.Get().(*buildStatus)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	live, _ := gLiveGeneration.Get().(int)
+	enc.Encode(struct {
+		Mode       string       `json:"mode"`
+		Back       string       `json:"back"`
+		Generation int          `json:"generation,omitempty"`
+		Build      *buildStatus `json:"build"`
+	}{
+		Mode:       gMode,
+		Back:       backHost.Get().(string),
+		Generation: live,
+		Build:      status,
+	})
+}
+
 func handleGep(w http.ResponseWriter, r *http.Request) {
-	req := *r
+	if gMode == "dev" {
+		if status, _ := gBuildStatus.Get().(*buildStatus); status != nil && !status.OK {
+			serveBuildErrors(w, r, status)
+			return
+		}
+	}
+
+	req := r.Clone(r.Context())
+
+	host := gInflight.acquire()
+	defer gInflight.release(host)
 
-	req.Host = backHost.Get().(string)
+	req.Host = host
 	req.URL.Scheme = "http"
 	req.URL.Host = req.Host
-	req.URL.Path = r.URL.Path
 	req.RequestURI = ""
 
-	resp, err := client.Do(&req)
+	resp, err := client.Do(req)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Internal error accessing %s: %v", r.URL.Path, err), http.StatusInternalServerError)
+		serveError(w, r, http.StatusServiceUnavailable, err, host)
 		return
 	}
 	defer resp.Body.Close()
 
-	for k, v := range resp.Header {
-		w.Header()[k] = v
+	if gMode == "dev" && isHTML(resp) {
+		copyHTMLResponse(w, resp)
+		return
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	copyResponse(w, resp)
+}
+
+// errorTmpl is the built-in error page, used when no back server is able to
+// render the error page.
+var errorTmpl = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>{{.Status}} {{.StatusText}}</title>
+</head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>Error accessing {{.URL}}</p>
+{{if .Error}}<pre>{{.Error}}</pre>{{end}}
+</body>
+</html>
+`))
+
+// serveError responds an error of status for r. The error page(e.g. 503.gep)
+// is rendered by the back server if available, or by errorTmpl otherwise.
+// failed is the back server failed to respond r, which is not asked again,
+// as it may hang every error page.
+func serveError(w http.ResponseWriter, r *http.Request, status int, err error, failed string) {
+	log.Printf("Error %d accessing %s: %v", status, r.URL, err)
+
+	host := gInflight.acquire()
+	defer gInflight.release(host)
+	if host != "" && host != failed {
+		q := url.Values{
+			"status": {strconv.Itoa(status)},
+			"url":    {r.URL.String()},
+		}
+		if err != nil {
+			q.Set("error", err.Error())
+		}
+		resp, err := errorPageClient.Get("http://" + host + "/__geps/error?" + q.Encode())
+		if err == nil {
+			defer resp.Body.Close()
+			copyResponse(w, resp)
+			return
+		}
+	}
+
+	var msg string
+	if err != nil && gMode == "dev" {
+		msg = err.Error()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	errorTmpl.Execute(w, struct {
+		Status          int
+		StatusText, URL string
+		Error           string
+	}{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		URL:        r.URL.String(),
+		Error:      msg,
+	})
 }
 
 var mediaSuffixes []string = []string{
@@ -171,6 +697,8 @@ var mediaSuffixes []string = []string{
 var gPaths struct {
 	webRoot            villa.Path
 	src, exe, tmp, inc villa.Path
+	// folder of plain .go files, webRoot if empty
+	lib villa.Path
 }
 
 func isMediaFile(lowerPath string) bool {
@@ -209,11 +737,6 @@ var gConf *ljconf.Conf
 
 const GEPS_PKG_PATH = "github.com/daviddengcn/geps"
 
-func goPath() villa.Path {
-	p := os.Getenv("GOPATH")
-	return villa.Path(p).Join("src", GEPS_PKG_PATH, "gepsvr")
-}
-
 func loadConf() {
 	var err error
 	gConf, err = ljconf.Load(confFile)
@@ -228,13 +751,68 @@ func loadConf() {
 	if gPaths.tmp != "" {
 		gPaths.tmp = gPaths.tmp.AbsPath()
 	}
-	gPaths.inc = villa.Path(gConf.String("code.inc", goPath().S())).AbsPath()
+	gPaths.inc = villa.Path(gConf.String("code.inc", ""))
+	if gPaths.inc != "" {
+		gPaths.inc = gPaths.inc.AbsPath()
+	}
+	applyConf()
+	gMode = gConf.String("mode", gMode)
 
 	fmt.Printf("Path set: %+v\n", gPaths)
 }
 
+// applyConf sets the settings reloaded when the configuration file changes.
+// The others, i.e. mode, listen.addr, web.root, code.src, code.exe,
+// code.tmp, code.inc, back.ports and back.killwait, take effect after
+// restarting.
+func applyConf() {
+	gPaths.lib = villa.Path(gConf.String("code.lib", ""))
+	if gPaths.lib != "" {
+		gPaths.lib = gPaths.lib.AbsPath()
+	}
+
+	gGoEnv = gConf.StringList("code.goenv", nil)
+	gKeepTempDirs = gConf.Int("code.keeptmp", gKeepTempDirs)
+	gPageBuffer = gConf.Int("page.buffer", gPageBuffer)
+
+	gMaxRestarts = gConf.Int("back.maxrestarts", gMaxRestarts)
+	gMaxBackoff = time.Duration(gConf.Int("back.maxbackoff", int(gMaxBackoff)))
+	gStartTimeout = time.Duration(gConf.Int("back.starttimeout", int(gStartTimeout)))
+	gKeepGenerations = gConf.Int("back.keepgens", gKeepGenerations)
+	gWatchDelay = time.Duration(gConf.Int("watch.delay", int(gWatchDelay)))
+	gPollInterval = time.Duration(gConf.Int("watch.interval", int(gPollInterval)))
+}
+
+// reloadConf loads the configuration file again and applies it. The current
+// settings are kept if it fails to load, e.g. while being edited.
+func reloadConf() error {
+	conf, err := ljconf.Load(confFile)
+	if err != nil {
+		return err
+	}
+	gConf = conf
+	applyConf()
+	return nil
+}
+
+// commands maps sub-command names to their entries. An entry is called with
+// the remaining arguments and returns the exit code.
+var commands = map[string]func(args []string) int{
+	"vet":         vetCommand,
+	"gen":         genCommand,
+	"test":        testCommand,
+	"generations": generationsCommand,
+	"rollback":    rollbackCommand,
+}
+
 func main() {
 	loadConf()
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
 	startCompilingLoop()
 
 	addr := gConf.String("listen.addr", ":8080")
@@ -242,6 +820,10 @@ func main() {
 		addr = os.Args[1]
 	}
 	http.HandleFunc("/", handler)
+	http.HandleFunc("/__geps/status", handleStatus)
+	http.HandleFunc("/__geps/events", handleEvents)
+	http.HandleFunc("/__geps/generations", handleGenerations)
+	http.HandleFunc("/__geps/rollback", handleRollback)
 	log.Println("Front server listening at", addr)
 	http.ListenAndServe(addr, nil)
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"github.com/daviddengcn/go-villa"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWaitReady(t *testing.T) {
+	var readyAfter time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/__geps/health" || time.Now().Before(readyAfter) {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"status":"ok","pid":42}`)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	readyAfter = time.Now().Add(200 * time.Millisecond)
+	if err := waitReady(host, 42, nil, 2*time.Second); err != nil {
+		t.Errorf("Expected ready, but got %v", err)
+	}
+	if time.Now().Before(readyAfter) {
+		t.Errorf("Expected waiting until ready")
+	}
+
+	// another process on the port
+	if err := waitReady(host, 43, nil, 300*time.Millisecond); err == nil {
+		t.Errorf("Expected an error for a wrong pid")
+	}
+
+	done := make(chan struct{})
+	close(done)
+	if err := waitReady("localhost:1", 42, done, 2*time.Second); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Errorf("Expected exited, but got %v", err)
+	}
+}
+
+func TestInflight(t *testing.T) {
+	defer backHost.Set(backHost.Get())
+	var f inflight
+
+	backHost.Set("localhost:1")
+	old := f.acquire()
+	backHost.Set("localhost:2")
+	cur := f.acquire()
+	if old != "localhost:1" || cur != "localhost:2" {
+		t.Fatalf("Unexpected hosts: %s, %s", old, cur)
+	}
+	if f.wait(old, 100*time.Millisecond) {
+		t.Errorf("Expected timeout with a request in progress")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		f.release(old)
+	}()
+	if !f.wait(old, 2*time.Second) {
+		t.Errorf("Expected drained after the request done")
+	}
+	if n := f.count(cur); n != 1 {
+		t.Errorf("Expected 1 request on %s, but got %d", cur, n)
+	}
+}
+
+func TestTailWriter(t *testing.T) {
+	w := &tailWriter{max: 2}
+	fmt.Fprint(w, "line 1\nline 2\nli")
+	fmt.Fprint(w, "ne 3\npanic: boom")
+	if s := strings.Join(w.Lines(), "|"); s != "line 2|line 3|panic: boom" {
+		t.Errorf("Unexpected lines: %s", s)
+	}
+}
+
+func TestRestartDelay(t *testing.T) {
+	defer func(max time.Duration) { gMaxBackoff = max }(gMaxBackoff)
+	gMaxBackoff = 5
+	for n, d := range []time.Duration{1, 1, 2, 4, 5, 5} {
+		if act := restartDelay(n); act != d*time.Second {
+			t.Errorf("restartDelay(%d): expected %v, but got %v", n, d*time.Second, act)
+		}
+	}
+}
+
+func TestStartBackServer_failure(t *testing.T) {
+	dir, err := villa.Path("").TempDir("geps_start_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.RemoveAll()
+	dir = dir.AbsPath()
+	defer func(root villa.Path) { gPaths.webRoot = root }(gPaths.webRoot)
+	gPaths.webRoot = dir
+
+	// a back server whose OnStart hook fails
+	exe := dir.Join("gepsvr-1.exe")
+	exe.WriteFile([]byte("#!/bin/sh\necho 'OnStart: database down' >&2\nexit 1\n"), 0777)
+	s, err := startBackServer(exe, "localhost:1")
+	if s != nil || err == nil {
+		t.Fatalf("Expected a failure, but got %v, %v", s, err)
+	}
+	defer gBuildStatus.Set(gBuildStatus.Get())
+	gBuildStatus.Set(&buildStatus{OK: true})
+	startFailed(err)
+	status := gBuildStatus.Get().(*buildStatus)
+	if status.OK {
+		t.Errorf("Expected the status not OK")
+	}
+	errs := status.Errors
+	if len(errs) != 2 || !strings.Contains(errs[0].Msg, "failed to start") || errs[1].Msg != "OnStart: database down" {
+		t.Errorf("Unexpected errors: %+v", errs)
+	}
+}
+
+func TestReloadConf(t *testing.T) {
+	dir, err := villa.Path("").TempDir("geps_conf_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.RemoveAll()
+	dir = dir.AbsPath()
+
+	file, conf, paths, env, buffer, keep := confFile, gConf, gPaths, gGoEnv, gPageBuffer, gKeepGenerations
+	defer func() {
+		confFile, gConf, gPaths, gGoEnv, gPageBuffer, gKeepGenerations = file, conf, paths, env, buffer, keep
+	}()
+	confFile = dir.Join("geps.conf").S()
+
+	villa.Path(confFile).WriteFile([]byte(`{"code": {"lib": "`+dir.Join("lib").S()+`", "goenv": ["GOFLAGS=-mod=mod"]},
+"page": {"buffer": 100}, "back": {"keepgens": 2}}`), 0666)
+	if err := reloadConf(); err != nil {
+		t.Fatal(err)
+	}
+	if gPaths.lib != dir.Join("lib") || len(gGoEnv) != 1 || gPageBuffer != 100 || gKeepGenerations != 2 {
+		t.Errorf("Settings not reloaded: lib %v, goenv %v, buffer %d, keepgens %d", gPaths.lib, gGoEnv, gPageBuffer, gKeepGenerations)
+	}
+
+	// a file half edited keeps the settings
+	villa.Path(confFile).WriteFile([]byte(`{"page": {"buffer": `), 0666)
+	if err := reloadConf(); err == nil {
+		t.Errorf("Expected an error for an invalid configuration")
+	}
+	if gPaths.lib != dir.Join("lib") || gPageBuffer != 100 {
+		t.Errorf("Expected settings kept, but got lib %v, buffer %d", gPaths.lib, gPageBuffer)
+	}
+}
+
+func TestKillBackServer_deadline(t *testing.T) {
+	defer func(wait time.Duration) { gWaitBeforeKill = wait }(gWaitBeforeKill)
+	gWaitBeforeKill = 1
+	defer backHost.Set(backHost.Get())
+
+	// a back server ignoring SIGTERM, with a request never done
+	cmd := exec.Command("sh", "-c", "trap '' TERM; exec sleep 30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s := &backServer{cmd: cmd, done: make(chan struct{}), started: time.Now()}
+	go func() {
+		cmd.Wait()
+		close(s.done)
+	}()
+	backHost.Set("localhost:1")
+	host := gInflight.acquire()
+	defer gInflight.release(host)
+
+	var lock sync.Mutex
+	lock.Lock()
+	start := time.Now()
+	killBackServer(s, "gepsvr-1.exe", host, &lock)
+	if d := time.Since(start); d > 1500*time.Millisecond {
+		t.Errorf("Expected killed in about %ds, but took %v", gWaitBeforeKill, d)
+	}
+	if !s.exited() {
+		t.Errorf("Expected the back server killed")
+	}
+}
+
+func TestServeError_backServer(t *testing.T) {
+	var asked int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&asked, 1)
+		if r.URL.Query().Get("url") == "/hang.gep" {
+			time.Sleep(time.Second)
+		}
+		fmt.Fprint(w, "page of ", r.URL.Query().Get("status"))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	defer backHost.Set(backHost.Get())
+	backHost.Set(host)
+	defer func(timeout time.Duration) { errorPageClient.Timeout = timeout }(errorPageClient.Timeout)
+	errorPageClient.Timeout = 100 * time.Millisecond
+
+	serve := func(url, failed string) string {
+		rec := httptest.NewRecorder()
+		serveError(rec, httptest.NewRequest("GET", url, nil), http.StatusServiceUnavailable, nil, failed)
+		return rec.Body.String()
+	}
+	if body := serve("/a.gep", ""); body != "page of 503" {
+		t.Errorf("Expected the page of the back server, but got %q", body)
+	}
+	// the back server failed is not asked
+	if body := serve("/a.gep", host); atomic.LoadInt32(&asked) != 1 || !strings.Contains(body, "503 Service Unavailable") {
+		t.Errorf("Expected the built-in page without asking, but got %d %q", atomic.LoadInt32(&asked), body)
+	}
+	// a back server hanging
+	start := time.Now()
+	if body := serve("/hang.gep", ""); !strings.Contains(body, "503 Service Unavailable") || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Expected the built-in page in time, but got %q in %v", body, time.Since(start))
+	}
+}
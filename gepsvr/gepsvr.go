@@ -1,69 +1,959 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/daviddengcn/geps/utils"
 	"github.com/russross/blackfriday"
 	"html/template"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
+// runtimeVersion is checked by geps against its embedded runtime when
+// gepsvr.go is overridden by code.inc. Change it when the interface between
+// generated code and the runtime changes.
+const runtimeVersion = "3"
+
 // map from path to HandlerFunc
 var processors map[string]http.HandlerFunc = map[string]http.HandlerFunc{}
 
-// registerPath registers a path-HandlerFunc pair in processors
-func registerPath(path string, f http.HandlerFunc) {
-	log.Println("Register path:", path)
+// map from path to the paths of its middlewares, i.e. the route table
+var routes = map[string][]string{}
+
+// middleware is a _middleware.gep wrapping pages in its directory and
+// subdirectories. f calls next to continue, or returns to short-circuit.
+type middleware struct {
+	path string
+	f    func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc)
+}
+
+// registerPath registers a path-HandlerFunc pair in processors. f is wrapped
+// by middlewares, the first one outermost. Error pages are not wrapped, as
+// serveError renders them for requests the middlewares have already run
+// for, and a middleware calling Error would otherwise recurse endlessly.
+func registerPath(path string, f http.HandlerFunc, middlewares ...middleware) {
+	if isErrorPage(path) {
+		middlewares = nil
+	}
+	mwPaths := make([]string, len(middlewares))
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		mw, next := middlewares[i], f
+		f = func(w http.ResponseWriter, r *http.Request) {
+			mw.f(w, r, next)
+		}
+		mwPaths[i] = mw.path
+	}
+	if len(mwPaths) > 0 {
+		log.Println("Register path:", path, "middlewares:", strings.Join(mwPaths, " "))
+	} else {
+		log.Println("Register path:", path)
+	}
 	processors[path] = f
+	routes[path] = mwPaths
 }
 
+// handleRoutes shows the route table, one page per line followed by its
+// middlewares.
+func handleRoutes(w http.ResponseWriter, r *http.Request) {
+	paths := make([]string, 0, len(routes))
+	for path := range routes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, path := range paths {
+		fmt.Fprintln(w, strings.Join(append([]string{path}, routes[path]...), " "))
+	}
+}
+
+// whether the back server runs in development mode, set by geps
+var devMode = os.Getenv("GEPS_MODE") == "dev"
+
+// ready is 1 once the back server is ready for requests
+var ready int32
+
+// handleHealth is the readiness check of geps. It responds the pid, so that
+// geps knows the response is from the process it started.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, struct {
+		Status string `json:"status"`
+		Pid    int    `json:"pid"`
+	}{"ok", os.Getpid()})
+}
+
+// brokenPage returns the handler of a page left out of a partial build for
+// errors, a stub responding 500 with the errors in development mode.
+func brokenPage(path, errs string) http.HandlerFunc {
+	log.Println("Broken page:", path)
+	return func(w http.ResponseWriter, r *http.Request) {
+		serveBroken(w, r, path, errs)
+	}
+}
+
+// brokenMiddleware returns the stub of a middleware left out of a partial
+// build. It never calls next, so pages behind it are not exposed.
+func brokenMiddleware(path, errs string) func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	log.Println("Broken middleware:", path)
+	return func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+		serveBroken(w, r, path, errs)
+	}
+}
+
+// serveBroken responds to r for the page of path failed to build
+func serveBroken(w http.ResponseWriter, r *http.Request, path, errs string) {
+	log.Printf("%s: page %s failed to build", r.URL.Path, path)
+	if !devMode {
+		serveError(w, r, http.StatusInternalServerError, fmt.Errorf("%s failed to build", path))
+		return
+	}
+	if strings.HasSuffix(path, ".json.gep") {
+		writeJSON(w, r, http.StatusInternalServerError, &APIError{
+			Status:  http.StatusInternalServerError,
+			Message: path + " failed to build:\n" + errs})
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	if err := brokenTmpl.Execute(w, struct{ Path, Errors string }{path, errs}); err != nil {
+		log.Println("Rendering error page:", err)
+	}
+}
+
+// brokenTmpl is the developer error page of a broken page
+var brokenTmpl = template.Must(template.New("broken").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>Build failed: {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #fdd; padding: 0.5em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>Build failed: {{.Path}}</h1>
+<pre>{{.Errors}}</pre>
+</body>
+</html>
+`))
+
 func handler(w http.ResponseWriter, r *http.Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			recoverPage(w, r, v)
+		}
+	}()
+
 	path := r.URL.Path
-	if proc, ok := processors[path]; ok {
+	if proc, ok := processors[path]; ok && !isErrorPage(path) {
 		proc(w, r)
 	} else {
-		http.NotFound(w, r)
+		serveError(w, r, http.StatusNotFound, nil)
+	}
+}
+
+// recoverPage responds to r for a panic v in processing it. A developer
+// error page is shown in development mode, or 500.gep if exists otherwise.
+func recoverPage(w http.ResponseWriter, r *http.Request, v interface{}) {
+	p, ok := v.(*pagePanic)
+	if !ok {
+		p = &pagePanic{value: v, stack: debug.Stack()}
+	}
+	log.Printf("%s: panic: %v\n%s", r.URL.Path, p.value, p.stack)
+	if p.committed {
+		// Too late for an error page
+		return
+	}
+
+	if p.api {
+		e := &APIError{Status: http.StatusInternalServerError,
+			Message: http.StatusText(http.StatusInternalServerError)}
+		if devMode {
+			e.Message = fmt.Sprintf("panic: %v", p.value)
+		}
+		writeJSON(w, r, e.Status, e)
+		return
+	}
+
+	if devMode {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		err := panicTmpl.Execute(w, struct {
+			Path   string
+			Value  string
+			Frames []stackFrame
+			Stack  string
+		}{
+			Path:   r.URL.Path,
+			Value:  fmt.Sprint(p.value),
+			Frames: parseStack(string(p.stack)),
+			Stack:  string(p.stack),
+		})
+		if err != nil {
+			log.Println("Rendering error page:", err)
+		}
+		return
+	}
+
+	serveError(w, r, http.StatusInternalServerError, fmt.Errorf("panic: %v", p.value))
+}
+
+// statusWriter is an http.ResponseWriter sending a fixed status code
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(int) {
+	if !w.wrote {
+		w.wrote = true
+		w.ResponseWriter.WriteHeader(w.status)
 	}
 }
 
+func (w *statusWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(w.status)
+	return w.ResponseWriter.Write(p)
+}
+
+// ErrorInfo is the information of an error for error pages
+type ErrorInfo struct {
+	// The status code
+	Status int
+	// The original URL requested
+	URL string
+	// The error, may be nil
+	Err error
+}
+
+type errorInfoKey struct{}
+
+// GetError returns the information of the error, if request is for an error
+// page, or nil otherwise.
+func GetError(request *http.Request) *ErrorInfo {
+	info, _ := request.Context().Value(errorInfoKey{}).(*ErrorInfo)
+	return info
+}
+
+const errorPage = "/_error.gep"
+
+// isErrorPage returns true if path is an error page. Error pages are only
+// available through serveError.
+func isErrorPage(path string) bool {
+	if path == errorPage {
+		return true
+	}
+	status, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, "/"), ".gep"))
+	return err == nil && http.StatusText(status) != "" && path == fmt.Sprintf("/%d.gep", status)
+}
+
+// serveError responds an error of status with the page of /<status>.gep or
+// /_error.gep, or a plain text if neither exists. The page gets the error with
+// GetError.
+func serveError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	proc, ok := processors[fmt.Sprintf("/%d.gep", status)]
+	if !ok {
+		proc, ok = processors[errorPage]
+	}
+	if !ok {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	info := &ErrorInfo{Status: status, URL: r.URL.String(), Err: err}
+	sw := &statusWriter{ResponseWriter: w, status: status}
+	defer func() {
+		if v := recover(); v != nil {
+			log.Printf("%s: panic in error page %d: %v", r.URL.Path, status, v)
+			if !sw.wrote {
+				http.Error(w, http.StatusText(status), status)
+			}
+		}
+	}()
+	proc(sw, r.WithContext(context.WithValue(r.Context(), errorInfoKey{}, info)))
+}
+
+// handleError renders the error page of an error in the front server, with
+// the status code, original URL and error message in the query.
+func handleError(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	status, err := strconv.Atoi(q.Get("status"))
+	if err != nil || http.StatusText(status) == "" {
+		status = http.StatusInternalServerError
+	}
+	var pageErr error
+	if msg := q.Get("error"); msg != "" {
+		pageErr = errors.New(msg)
+	}
+	u, err := url.Parse(q.Get("url"))
+	if err != nil {
+		u = &url.URL{}
+	}
+
+	req := r.Clone(r.Context())
+	req.URL, req.RequestURI = u, u.RequestURI()
+	serveError(w, req, status, pageErr)
+}
+
+// stackFrame is a frame in a stack trace
+type stackFrame struct {
+	Func string
+	File string
+	Line int
+	// Source lines around Line, for frames in GEP files
+	Excerpt []utils.SourceLine
+}
+
+// parseStack parses a stack trace from debug.Stack. Excerpts are read for
+// frames in GEP files, whose positions are mapped by the line directives in
+// generated sources.
+func parseStack(stack string) (frames []stackFrame) {
+	lines := strings.Split(stack, "\n")
+	for i := 1; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "\t") {
+			continue
+		}
+		loc := strings.TrimSpace(lines[i])
+		if j := strings.LastIndex(loc, " +0x"); j >= 0 {
+			loc = loc[:j]
+		}
+		j := strings.LastIndex(loc, ":")
+		if j < 0 {
+			continue
+		}
+		line, err := strconv.Atoi(loc[j+1:])
+		if err != nil {
+			continue
+		}
+		frame := stackFrame{Func: lines[i-1], File: loc[:j], Line: line}
+		if strings.HasSuffix(strings.ToLower(frame.File), ".gep") {
+			frame.Excerpt = readExcerpt(frame.File, line, 3)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// readExcerpt returns lines around line in file. The back server runs in the
+// web root, so leading folders of file are stripped until it is found.
+func readExcerpt(file string, line, around int) []utils.SourceLine {
+	file = filepath.ToSlash(file)
+	for {
+		src, err := os.ReadFile(file)
+		if err == nil {
+			return utils.Excerpt(src, line, around)
+		}
+		i := strings.Index(file, "/")
+		if i < 0 {
+			return nil
+		}
+		file = strings.TrimLeft(file[i+1:], "/")
+	}
+}
+
+// panicTmpl is the developer error page for a panic
+var panicTmpl = template.Must(template.New("panic").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>Panic in {{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f6f6f6; padding: 0.5em; overflow: auto; }
+.current { background: #fdd; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Panic in {{.Path}}</h1>
+<pre>{{.Value}}</pre>
+{{range .Frames}}{{if .Excerpt}}
+<h3>{{.File}}:{{.Line}} <small>{{.Func}}</small></h3>
+<pre>{{range .Excerpt}}<span{{if .Current}} class="current"{{end}}>{{printf "%5d" .No}}  {{.Text}}</span>
+{{end}}</pre>
+{{end}}{{end}}
+<h2>Stack</h2>
+<pre>{{.Stack}}</pre>
+</body>
+</html>
+`))
+
 func main() {
 	host := ":8081"
 	if len(os.Args) > 1 {
 		host = os.Args[1]
 	}
 	http.HandleFunc("/", handler)
+	http.HandleFunc("/__geps/error", handleError)
+	http.HandleFunc("/__geps/routes", handleRoutes)
+	http.HandleFunc("/__geps/health", handleHealth)
+
+	if err := theApp.start(); err != nil {
+		// exiting non-zero keeps the front server on the previous back server
+		log.Println("Starting app failed:", err)
+		os.Exit(1)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	ln, err := net.Listen("tcp", host)
+	if err != nil {
+		log.Println("Listening failed:", err)
+		theApp.stop()
+		os.Exit(1)
+	}
 	log.Println("Back server listening at", host)
-	http.ListenAndServe(host, nil)
+	err = serve(&http.Server{}, ln, sig)
+	theApp.stop()
+	if err != nil {
+		log.Println("Back server stopped:", err)
+		os.Exit(1)
+	}
+	log.Println("Back server stopped")
+	os.Exit(0)
+}
+
+// serve serves requests on ln until a signal from sig. It then stops
+// accepting requests, reports not ready, and returns nil after requests in
+// progress are done.
+func serve(srv *http.Server, ln net.Listener, sig <-chan os.Signal) error {
+	shutdown := make(chan error, 1)
+	go func() {
+		log.Println("Back server stopping:", <-sig)
+		atomic.StoreInt32(&ready, 0)
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	atomic.StoreInt32(&ready, 1)
+	if err := srv.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdown
+}
+
+// App is the state shared by all pages, available as page.App(). It is
+// initialized by the code of _app.gep, the OnStart hook, before the back
+// server starts listening.
+type App struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+	stops  []func(app *App) error
+}
+
+// the App of the back server
+var theApp = &App{}
+
+// OnStart hooks of the App, added by registerApp
+var appStarts []func(app *App) error
+
+// registerApp adds an OnStart hook, generated from _app.gep, or defined as
+// OnStart in a .go file.
+func registerApp(start func(app *App) error) {
+	appStarts = append(appStarts, start)
+}
+
+// Set sets the shared value of key
+func (a *App) Set(key string, value interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.values == nil {
+		a.values = make(map[string]interface{})
+	}
+	a.values[key] = value
+}
+
+// Get returns the shared value of key, or nil if not set
+func (a *App) Get(key string) interface{} {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.values[key]
+}
+
+// OnStop adds a hook called when the back server stops, e.g. closing
+// resources opened at start. Hooks are called in reverse order.
+func (a *App) OnStop(f func(app *App) error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stops = append(a.stops, f)
+}
+
+// start calls the OnStart hooks. A panic is returned as an error.
+func (a *App) start() (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v\n%s", v, debug.Stack())
+		}
+	}()
+	for _, start := range appStarts {
+		if err := start(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stop calls the OnStop hooks once
+func (a *App) stop() {
+	a.mu.Lock()
+	stops := a.stops
+	a.stops = nil
+	a.mu.Unlock()
+
+	for i := len(stops) - 1; i >= 0; i-- {
+		func() {
+			defer func() {
+				if v := recover(); v != nil {
+					log.Println("OnStop panic:", v)
+				}
+			}()
+			if err := stops[i](a); err != nil {
+				log.Println("OnStop failed:", err)
+			}
+		}()
+	}
 }
 
-// for gep files
-func __print__(response http.ResponseWriter, s interface{}) {
-	response.Write([]byte(fmt.Sprint(s)))
+// Raw is a string written to the output as is
+type Raw string
+
+// Page is the context of a page, available as page in GEP files. It is also
+// the http.ResponseWriter of the page. Output of the page is buffered by a
+// pooled bufio.Writer, whose size is the limit before streaming starts.
+// Before anything is sent, the status code and headers can be changed and
+// the buffered output can be discarded for an error or a redirect. With a
+// limit of 0, the output is sent to the client as soon as written.
+//
+// A Page is reused after the page finishes, so it should not be kept.
+type Page struct {
+	http.ResponseWriter
+	request *http.Request
+	buf     *bufio.Writer
+
+	// status code sent when the output is committed
+	status int
+	// whether the header has been sent
+	committed bool
+	// whether the page is a JSON API page
+	api bool
+	// whether the output is sent as soon as written, i.e. a limit of 0
+	stream bool
+}
+
+// pageOutput is the underlying writer of Page.buf
+type pageOutput Page
+
+func (o *pageOutput) Write(p []byte) (int, error) {
+	(*Page)(o).commit()
+	return o.ResponseWriter.Write(p)
+}
+
+// pools of *Page, keyed by buffer limits
+var pagePools sync.Map
+
+func pagePool(limit int) *sync.Pool {
+	if pool, ok := pagePools.Load(limit); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := pagePools.LoadOrStore(limit, &sync.Pool{
+		New: func() interface{} {
+			return &Page{buf: bufio.NewWriterSize(nil, limit)}
+		},
+	})
+	return pool.(*sync.Pool)
+}
+
+// for gep files. limit is the size of the buffer, 4096 if negative. The
+// output is not buffered if limit is 0.
+func __newPage__(response http.ResponseWriter, request *http.Request, limit int) *Page {
+	if limit < 0 {
+		limit = 4096
+	}
+	w := pagePool(limit).Get().(*Page)
+	w.ResponseWriter, w.request = response, request
+	w.status, w.committed, w.api, w.stream = http.StatusOK, false, false, limit == 0
+	w.buf.Reset((*pageOutput)(w))
+	return w
+}
+
+// for JSON API pages, i.e. *.json.gep or pages with <%!page api%>.
+func __newAPIPage__(response http.ResponseWriter, request *http.Request, limit int) *Page {
+	w := __newPage__(response, request, limit)
+	w.api = true
+	return w
+}
+
+func (w *Page) Write(p []byte) (int, error) {
+	n, err := w.buf.Write(p)
+	w.streamOut()
+	return n, err
+}
+
+func (w *Page) WriteString(s string) (int, error) {
+	n, err := w.buf.WriteString(s)
+	w.streamOut()
+	return n, err
+}
+
+// streamOut sends the output written to the client if the page is not
+// buffered
+func (w *Page) streamOut() {
+	if w.stream {
+		w.Flush()
+	}
+}
+
+// WriteHeader sets the status code sent when the output is committed
+func (w *Page) WriteHeader(status int) {
+	if w.committed {
+		log.Printf("%s: status %d ignored, output committed", w.request.URL.Path, status)
+		return
+	}
+	w.status = status
+}
+
+// commit sends the header if not yet
+func (w *Page) commit() {
+	if !w.committed {
+		w.committed = true
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// Flush sends the buffered output to the client. It implements http.Flusher.
+func (w *Page) Flush() {
+	w.commit()
+	w.buf.Flush()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Request returns the request of the page
+func (w *Page) Request() *http.Request {
+	return w.request
+}
+
+// Context returns the context of the request
+func (w *Page) Context() context.Context {
+	return w.request.Context()
+}
+
+// App returns the state shared by all pages
+func (w *Page) App() *App {
+	return theApp
+}
+
+// Param returns the first value of the named parameter in the URL query, or
+// an empty string if not found.
+func (w *Page) Param(name string) string {
+	return w.request.URL.Query().Get(name)
+}
+
+// Form returns the first value of the named field in the POST/PUT body or
+// the URL query, or an empty string if not found.
+func (w *Page) Form(name string) string {
+	return w.request.FormValue(name)
+}
+
+// Cookie returns the value of the named cookie, or an empty string if not
+// found.
+func (w *Page) Cookie(name string) string {
+	c, err := w.request.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// SetCookie adds a Set-Cookie header. It is ignored after the output is
+// committed.
+func (w *Page) SetCookie(c *http.Cookie) {
+	if w.committed {
+		log.Printf("%s: cookie %s ignored, output committed", w.request.URL.Path, c.Name)
+		return
+	}
+	http.SetCookie(w.ResponseWriter, c)
+}
+
+// Status sets the status code sent when the output is committed
+func (w *Page) Status(status int) {
+	w.WriteHeader(status)
+}
+
+// Redirect stops the page and redirects the request to url. Output of the
+// page is discarded if not flushed yet.
+func (w *Page) Redirect(url string) {
+	Redirect(url)
+}
+
+// JSON writes v encoded in JSON, and sets the content type if not set. The
+// output is indented if the request has a pretty parameter.
+func (w *Page) JSON(v interface{}) error {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	}
+	defer w.streamOut()
+	return newJSONEncoder(w.buf, w.request).Encode(v)
+}
+
+// Decode decodes the JSON request body into v. The returned error is an
+// *APIError with status 400, so it can be passed to Error directly.
+func (w *Page) Decode(v interface{}) error {
+	if err := json.NewDecoder(w.request.Body).Decode(v); err != nil {
+		return &APIError{Status: http.StatusBadRequest, Message: "invalid JSON body: " + err.Error()}
+	}
+	return nil
+}
+
+// newJSONEncoder returns a json.Encoder writing to out, indenting if r has a
+// pretty parameter.
+func newJSONEncoder(out io.Writer, r *http.Request) *json.Encoder {
+	enc := json.NewEncoder(out)
+	if _, ok := r.URL.Query()["pretty"]; ok {
+		enc.SetIndent("", "  ")
+	}
+	return enc
+}
+
+// writeJSON sends v encoded in JSON with the status code
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := newJSONEncoder(w, r).Encode(v); err != nil {
+		log.Printf("%s: encoding JSON: %v", r.URL.Path, err)
+	}
+}
+
+// APIError is the body of an error response of JSON API pages. It can be
+// passed to Error to set the message and the code.
+type APIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return e.Code + ": " + e.Message
+	}
+	return e.Message
+}
+
+// Abort stops the page. Output written so far is sent.
+func (w *Page) Abort() {
+	panic(abortResponse)
+}
+
+// pageResponse is panicked by Error, Redirect and Page.Abort, and handled
+// by Page.finish.
+type pageResponse struct {
+	status int
+	err    error
+	url    string
+	// value sent in JSON if isValue is true
+	value   interface{}
+	isValue bool
+}
+
+// abortResponse is the pageResponse of Page.Abort
+var abortResponse = &pageResponse{}
+
+// Error stops the page and responds with the error page of the status code.
+// Output of the page is discarded if not flushed yet.
+func Error(status int, err error) {
+	panic(&pageResponse{status: status, err: err})
+}
+
+// Redirect stops the page and redirects the request to url. Output of the
+// page is discarded if not flushed yet.
+func Redirect(url string) {
+	panic(&pageResponse{status: http.StatusFound, url: url})
+}
+
+// Respond stops the page and sends v encoded in JSON with the status code
+// of the page. Output of the page is discarded if not flushed yet.
+func Respond(v interface{}) {
+	panic(&pageResponse{value: v, isValue: true})
+}
+
+// respond discards the buffered output and sends resp instead. Errors are
+// sent as APIError in JSON API pages.
+func (w *Page) respond(resp *pageResponse) {
+	path := w.request.URL.Path
+	if resp.isValue {
+		resp.status = w.status
+	}
+	if resp.err != nil {
+		log.Printf("%s: error %d: %v", path, resp.status, resp.err)
+	}
+	if w.committed {
+		log.Printf("%s: response %d dropped, output committed", path, resp.status)
+		return
+	}
+	w.buf.Reset((*pageOutput)(w))
+	w.committed = true
+	switch {
+	case resp.isValue:
+		writeJSON(w.ResponseWriter, w.request, resp.status, resp.value)
+	case resp.url != "":
+		http.Redirect(w.ResponseWriter, w.request, resp.url, resp.status)
+	case w.api:
+		writeJSON(w.ResponseWriter, w.request, resp.status, apiError(resp.status, resp.err))
+	default:
+		serveError(w.ResponseWriter, w.request, resp.status, resp.err)
+	}
+}
+
+// apiError returns the APIError of err with the status code. The message of
+// errors other than *APIError is shown in development mode only.
+func apiError(status int, err error) *APIError {
+	var e APIError
+	if ae := (*APIError)(nil); errors.As(err, &ae) {
+		e = *ae
+	} else {
+		e.Message = http.StatusText(status)
+		if devMode && err != nil {
+			e.Message = err.Error()
+		}
+	}
+	e.Status = status
+	return &e
+}
+
+// pagePanic is panicked by Page.finish for a panic in a page, and
+// handled by handler.
+type pagePanic struct {
+	value interface{}
+	stack []byte
+	// whether the output had been sent before the panic
+	committed bool
+	// whether the panic is in a JSON API page
+	api bool
+}
+
+// finish handles the response of Error, Redirect or Abort, flushes the output and
+// returns the writer to the pool. It is deferred by generated functions.
+// Other panics are repanicked as *pagePanic with buffered output discarded.
+func (w *Page) finish() {
+	r := recover()
+	if resp, ok := r.(*pageResponse); ok {
+		if resp != abortResponse {
+			w.respond(resp)
+		}
+		r = nil
+	}
+	if p, ok := r.(*pagePanic); ok {
+		// from a page wrapped by this middleware, whose output goes to w
+		p.committed = w.committed
+	} else if r != nil {
+		// stack of the panic is still available in a deferred function
+		r = &pagePanic{value: r, stack: debug.Stack(), committed: w.committed, api: w.api}
+	}
+	if r == nil {
+		w.buf.Flush()
+		w.commit()
+	}
+
+	limit := w.buf.Size()
+	if w.stream {
+		limit = 0
+	}
+	w.buf.Reset(nil)
+	w.ResponseWriter, w.request = nil, nil
+	pagePool(limit).Put(w)
+
+	if r != nil {
+		panic(r)
+	}
+}
+
+// for gep files. Common types are written without fmt.
+func __print__[T any](w *Page, s T) {
+	switch v := any(s).(type) {
+	case string:
+		w.buf.WriteString(v)
+	case Raw:
+		w.buf.WriteString(string(v))
+	case []byte:
+		w.buf.Write(v)
+	case int:
+		w.buf.Write(strconv.AppendInt(w.buf.AvailableBuffer(), int64(v), 10))
+	case int8:
+		w.buf.Write(strconv.AppendInt(w.buf.AvailableBuffer(), int64(v), 10))
+	case int16:
+		w.buf.Write(strconv.AppendInt(w.buf.AvailableBuffer(), int64(v), 10))
+	case int32:
+		w.buf.Write(strconv.AppendInt(w.buf.AvailableBuffer(), int64(v), 10))
+	case int64:
+		w.buf.Write(strconv.AppendInt(w.buf.AvailableBuffer(), v, 10))
+	case uint:
+		w.buf.Write(strconv.AppendUint(w.buf.AvailableBuffer(), uint64(v), 10))
+	case uint8:
+		w.buf.Write(strconv.AppendUint(w.buf.AvailableBuffer(), uint64(v), 10))
+	case uint16:
+		w.buf.Write(strconv.AppendUint(w.buf.AvailableBuffer(), uint64(v), 10))
+	case uint32:
+		w.buf.Write(strconv.AppendUint(w.buf.AvailableBuffer(), uint64(v), 10))
+	case uint64:
+		w.buf.Write(strconv.AppendUint(w.buf.AvailableBuffer(), v, 10))
+	default:
+		// converting s again, so that v does not escape in other cases
+		fmt.Fprint(w.buf, s)
+	}
+	w.streamOut()
+}
+
+// toString converts text to a string, without fmt if it is a string already
+func toString(text interface{}) string {
+	if s, ok := text.(string); ok {
+		return s
+	}
+	return fmt.Sprint(text)
 }
 
 /* <html>$text</html> */
 func Html(text interface{}) string {
-	return utils.HTMLEscapeString(fmt.Sprint(text))
+	return utils.HTMLEscapeString(toString(text))
 }
 
 /* <input attr='$text'> <pre>$text</pre> <textarea>$text</textarea>*/
 func Value(text interface{}) string {
-	return template.HTMLEscapeString(fmt.Sprint(text))
+	return template.HTMLEscapeString(toString(text))
 }
 
 /* http://xxx.xxx/?xxx=$text */
 func Query(text interface{}) string {
-	return template.URLQueryEscaper(fmt.Sprint(text))
+	return template.URLQueryEscaper(toString(text))
 }
 
 /* <script> s='$text' </script> */
 func JS(text interface{}) string {
-	return template.JSEscaper(fmt.Sprint(text))
+	return template.JSEscaper(toString(text))
 }
 
 // Markdown converts a markdown markup text into HTML
 func Markdown(text interface{}) string {
-	return string(blackfriday.MarkdownCommon([]byte(fmt.Sprint(text))))
+	return string(blackfriday.MarkdownCommon([]byte(toString(text))))
 }
@@ -1,7 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestEscapeFuncs(t *testing.T) {
@@ -28,6 +42,654 @@ func TestEscapeFuncs(t *testing.T) {
 func TestAssureExistence(t *testing.T) {
 	if false {
 		registerPath("", nil)
-		__print__(nil, nil)
+		__print__(nil, "")
+	}
+}
+
+// discardWriter is an http.ResponseWriter discarding the body
+type discardWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	return w.body.Write(p)
+}
+
+func (w *discardWriter) WriteHeader(int) {}
+
+func TestPrint(t *testing.T) {
+	w := &discardWriter{header: make(http.Header)}
+	page := __newPage__(w, nil, 0)
+	__print__(page, "a")
+	__print__(page, []byte("b"))
+	__print__(page, Raw("<c>"))
+	__print__(page, -12)
+	__print__(page, uint8(34))
+	__print__(page, 1.5)
+	__print__(page, []int{1})
+	page.finish()
+
+	if act, exp := w.body.String(), "ab<c>-12341.5[1]"; act != exp {
+		t.Errorf("Expected %q, but got %q", exp, act)
+	}
+}
+
+// runPage runs page as a generated function with a buffer of limit
+func runPage(limit int, page func(w *Page)) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	func() {
+		__response__ := __newPage__(rec, httptest.NewRequest("GET", "/a.gep", nil), limit)
+		defer __response__.finish()
+		page(__response__)
+	}()
+	return rec
+}
+
+func runAPIPage(url string, page func(w *Page)) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	func() {
+		defer func() {
+			if v := recover(); v != nil {
+				recoverPage(rec, httptest.NewRequest("GET", url, nil), v)
+			}
+		}()
+		__response__ := __newAPIPage__(rec, httptest.NewRequest("GET", url, nil), 4096)
+		defer __response__.finish()
+		page(__response__)
+	}()
+	return rec
+}
+
+func TestAPIPage(t *testing.T) {
+	rec := runAPIPage("/a.json.gep", func(w *Page) {
+		w.Status(http.StatusCreated)
+		Respond(map[string]int{"a": 1})
+	})
+	if rec.Code != http.StatusCreated {
+		t.Errorf("Expected status %d, but got %d", http.StatusCreated, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Expected JSON content type, but got %q", ct)
+	}
+	if body := rec.Body.String(); body != "{\"a\":1}\n" {
+		t.Errorf("Unexpected body %q", body)
+	}
+
+	rec = runAPIPage("/a.json.gep?pretty", func(w *Page) {
+		Respond(map[string]int{"a": 1})
+	})
+	if body := rec.Body.String(); body != "{\n  \"a\": 1\n}\n" {
+		t.Errorf("Expected indented body, but got %q", body)
+	}
+
+	rec = runAPIPage("/a.json.gep", func(w *Page) {
+		Error(http.StatusConflict, &APIError{Message: "exists", Code: "dup"})
+	})
+	if body := rec.Body.String(); rec.Code != http.StatusConflict ||
+		body != `{"status":409,"message":"exists","code":"dup"}`+"\n" {
+		t.Errorf("Unexpected error response %d %q", rec.Code, body)
+	}
+
+	rec = runAPIPage("/a.json.gep", func(w *Page) {
+		panic("boom")
+	})
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusInternalServerError ||
+		!strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Expected JSON 500 for a panic, but got %d %q", rec.Code, ct)
+	}
+}
+
+func TestPage_Decode(t *testing.T) {
+	var v struct{ A int }
+	r := httptest.NewRequest("POST", "/a.json.gep", strings.NewReader(`{"A": 2}`))
+	w := __newAPIPage__(httptest.NewRecorder(), r, 4096)
+	if err := w.Decode(&v); err != nil || v.A != 2 {
+		t.Errorf("Decode: %v, %+v", err, v)
+	}
+
+	r = httptest.NewRequest("POST", "/a.json.gep", strings.NewReader(`{`))
+	w = __newAPIPage__(httptest.NewRecorder(), r, 4096)
+	err := w.Decode(&v)
+	if e, ok := err.(*APIError); !ok || e.Status != http.StatusBadRequest {
+		t.Errorf("Expected an APIError of 400, but got %v", err)
+	}
+}
+
+func TestPageWriter_error(t *testing.T) {
+	rec := runPage(4096, func(w *Page) {
+		w.Header().Set("X-Page", "a")
+		__print__(w, "partial")
+		Error(http.StatusForbidden, errors.New("no access"))
+	})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d, but got %d", http.StatusForbidden, rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "partial") {
+		t.Errorf("Partial output should be discarded, but got %q", body)
+	}
+}
+
+func TestPageWriter_redirect(t *testing.T) {
+	rec := runPage(4096, func(w *Page) {
+		__print__(w, "partial")
+		Redirect("/b.gep")
+	})
+	if rec.Code != http.StatusFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusFound, rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "/b.gep" {
+		t.Errorf("Expected location /b.gep, but got %q", loc)
+	}
+}
+
+func TestPageWriter_status(t *testing.T) {
+	rec := runPage(4096, func(w *Page) {
+		__print__(w, "abc")
+		w.WriteHeader(http.StatusNotFound)
+	})
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, rec.Code)
+	}
+	if body := rec.Body.String(); body != "abc" {
+		t.Errorf("Expected body %q, but got %q", "abc", body)
+	}
+}
+
+func TestPageWriter_streaming(t *testing.T) {
+	// Output beyond the limit is streamed, so the error is too late
+	rec := runPage(16, func(w *Page) {
+		__print__(w, strings.Repeat("a", 32))
+		Error(http.StatusInternalServerError, errors.New("too late"))
+	})
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %d, but got %d", http.StatusOK, rec.Code)
+	}
+	if body := rec.Body.String(); body != strings.Repeat("a", 32) {
+		t.Errorf("Expected streamed output, but got %q", body)
+	}
+}
+
+func TestPageWriter_unbuffered(t *testing.T) {
+	var sent []string
+	rec := runPage(0, func(w *Page) {
+		__print__(w, 1)
+		sent = append(sent, w.ResponseWriter.(*httptest.ResponseRecorder).Body.String())
+		w.Write([]byte("b"))
+		sent = append(sent, w.ResponseWriter.(*httptest.ResponseRecorder).Body.String())
+		Error(http.StatusInternalServerError, errors.New("too late"))
+	})
+	if s := strings.Join(sent, " "); s != "1 1b" {
+		t.Errorf("Expected output sent as soon as written, but got %q", s)
+	}
+	if !rec.Flushed || rec.Code != http.StatusOK {
+		t.Errorf("Expected flushed with status %d, but got %v %d", http.StatusOK, rec.Flushed, rec.Code)
+	}
+
+	// a page reused from the pool is not buffered either
+	runPage(0, func(w *Page) {
+		if !w.stream {
+			t.Errorf("Expected a page without buffering")
+		}
+	})
+}
+
+var (
+	benchRaw0 = []byte("<html><body><ul>")
+	benchRaw1 = []byte("<li>")
+	benchRaw2 = []byte("</li>")
+	benchRaw3 = []byte("</ul></body></html>")
+)
+
+// benchPage simulates the generated code of a page
+func benchPage(response http.ResponseWriter, request *http.Request) {
+	__response__ := __newPage__(response, request, 64<<10)
+	defer __response__.finish()
+
+	__response__.Write(benchRaw0)
+	for i := 0; i < 10; i++ {
+		__response__.Write(benchRaw1)
+		__print__(__response__, i)
+		__print__(__response__, Html("item"))
+		__response__.Write(benchRaw2)
+	}
+	__response__.Write(benchRaw3)
+}
+
+// benchPageFmt simulates the generated code of a page before raw parts were
+// precomputed and evals were specialized.
+func benchPageFmt(response http.ResponseWriter) {
+	print := func(response http.ResponseWriter, s interface{}) {
+		response.Write([]byte(fmt.Sprint(s)))
+	}
+
+	print(response, "<html><body><ul>")
+	for i := 0; i < 10; i++ {
+		print(response, "<li>")
+		print(response, i)
+		print(response, Html("item"))
+		print(response, "</li>")
+	}
+	print(response, "</ul></body></html>")
+}
+
+func BenchmarkPage(b *testing.B) {
+	w := &discardWriter{header: make(http.Header)}
+	r := httptest.NewRequest("GET", "/bench.gep", nil)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.body.Reset()
+		benchPage(w, r)
+	}
+}
+
+func BenchmarkPage_fmt(b *testing.B) {
+	w := &discardWriter{header: make(http.Header)}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w.body.Reset()
+		benchPageFmt(w)
+	}
+}
+
+func TestHandler_panic(t *testing.T) {
+	defer func(mode bool) { devMode = mode }(devMode)
+	processors["/panic.gep"] = func(response http.ResponseWriter, request *http.Request) {
+		__response__ := __newPage__(response, request, 4096)
+		defer __response__.finish()
+		__print__(__response__, "partial")
+		panic("boom")
+	}
+	defer delete(processors, "/panic.gep")
+
+	devMode = false
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/panic.gep", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, but got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "partial") {
+		t.Errorf("Partial output should be discarded, but got %q", body)
+	}
+
+	processors["/500.gep"] = func(response http.ResponseWriter, request *http.Request) {
+		__response__ := __newPage__(response, request, 4096)
+		defer __response__.finish()
+		__print__(__response__, "custom error")
+	}
+	defer delete(processors, "/500.gep")
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/panic.gep", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, but got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if body := rec.Body.String(); body != "custom error" {
+		t.Errorf("Expected body %q, but got %q", "custom error", body)
+	}
+
+	devMode = true
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/panic.gep", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, but got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "boom") || !strings.Contains(body, "TestHandler_panic") {
+		t.Errorf("Expected panic value and stack in the page, but got %q", body)
+	}
+}
+
+func TestBrokenPage(t *testing.T) {
+	defer func(mode bool) { devMode = mode }(devMode)
+	registerPath("/broken.gep", brokenPage("/broken.gep", "broken.gep:1:5: undefined: x"),
+		middleware{"/_middleware.gep", brokenMiddleware("/_middleware.gep", "")})
+	defer delete(processors, "/broken.gep")
+	defer delete(routes, "/broken.gep")
+	registerPath("/b.gep", brokenPage("/b.gep", "b.gep:1:5: undefined: x"))
+	defer delete(processors, "/b.gep")
+	defer delete(routes, "/b.gep")
+
+	devMode = true
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/b.gep", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, but got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "undefined: x") {
+		t.Errorf("Expected build errors in the page, but got %q", body)
+	}
+
+	// the broken middleware responds instead of the page
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/broken.gep", nil))
+	if body := rec.Body.String(); !strings.Contains(body, "/_middleware.gep") {
+		t.Errorf("Expected the error of the middleware, but got %q", body)
+	}
+
+	devMode = false
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/b.gep", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, but got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "undefined") {
+		t.Errorf("Expected build errors hidden, but got %q", body)
+	}
+}
+
+func TestHandleHealth(t *testing.T) {
+	defer atomic.StoreInt32(&ready, atomic.LoadInt32(&ready))
+
+	atomic.StoreInt32(&ready, 0)
+	rec := httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/__geps/health", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, but got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	atomic.StoreInt32(&ready, 1)
+	rec = httptest.NewRecorder()
+	handleHealth(rec, httptest.NewRequest("GET", "/__geps/health", nil))
+	var health struct {
+		Status string
+		Pid    int
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK || health.Pid != os.Getpid() {
+		t.Errorf("Expected ready with pid %d, but got %d %s", os.Getpid(), rec.Code, rec.Body)
+	}
+}
+
+func TestServe_shutdown(t *testing.T) {
+	defer atomic.StoreInt32(&ready, atomic.LoadInt32(&ready))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "done")
+	})}
+	sig := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, ln, sig)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	<-started
+	sig <- syscall.SIGTERM
+
+	if b := <-body; b != "done" {
+		t.Errorf("Expected the request in progress done, but got %q", b)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Expected shut down gracefully, but got %v", err)
+	}
+	if atomic.LoadInt32(&ready) != 0 {
+		t.Errorf("Expected not ready after shut down")
+	}
+}
+
+func TestParseStack(t *testing.T) {
+	dir := t.TempDir()
+	src := "line 1\nline 2\nline 3\nline 4\n"
+	if err := os.WriteFile(filepath.Join(dir, "index.gep"), []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	stack := "goroutine 1 [running]:\n" +
+		"main.__process_gep_index_dgep(...)\n" +
+		"\t" + filepath.Join(dir, "index.gep") + ":2 +0x1d\n" +
+		"main.handler(...)\n" +
+		"\t/x/gepsvr.go:30 +0x2b\n"
+	frames := parseStack(stack)
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 frames, but got %+v", frames)
+	}
+	if frames[1].File != "/x/gepsvr.go" || frames[1].Line != 30 || frames[1].Excerpt != nil {
+		t.Errorf("Unexpected frame: %+v", frames[1])
+	}
+	excerpt := frames[0].Excerpt
+	if len(excerpt) != 4 || excerpt[0].No != 1 || !excerpt[1].Current || excerpt[1].Text != "line 2" {
+		t.Errorf("Unexpected excerpt: %+v", excerpt)
+	}
+}
+
+func TestServeError(t *testing.T) {
+	processors["/_error.gep"] = func(response http.ResponseWriter, request *http.Request) {
+		__response__ := __newPage__(response, request, 4096)
+		defer __response__.finish()
+		info := GetError(request)
+		__print__(__response__, fmt.Sprintf("%d %s %v", info.Status, info.URL, info.Err))
+	}
+	defer delete(processors, "/_error.gep")
+	processors["/denied.gep"] = func(response http.ResponseWriter, request *http.Request) {
+		__response__ := __newPage__(response, request, 4096)
+		defer __response__.finish()
+		Error(http.StatusForbidden, errors.New("denied"))
+	}
+	defer delete(processors, "/denied.gep")
+
+	cases := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"/missing.gep?a=1", http.StatusNotFound, "404 /missing.gep?a=1 <nil>"},
+		{"/_error.gep", http.StatusNotFound, "404 /_error.gep <nil>"},
+		{"/denied.gep", http.StatusForbidden, "403 /denied.gep denied"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", c.url, nil))
+		if rec.Code != c.status || rec.Body.String() != c.body {
+			t.Errorf("%s: expected %d %q, but got %d %q", c.url, c.status, c.body,
+				rec.Code, rec.Body.String())
+		}
+	}
+
+	// error page requested by the front server
+	rec := httptest.NewRecorder()
+	handleError(rec, httptest.NewRequest("GET",
+		"/__geps/error?status=503&url=%2Fa.gep&error=unavailable", nil))
+	if exp := "503 /a.gep unavailable"; rec.Code != 503 || rec.Body.String() != exp {
+		t.Errorf("Expected 503 %q, but got %d %q", exp, rec.Code, rec.Body.String())
+	}
+}
+
+func TestIsErrorPage(t *testing.T) {
+	cases := map[string]bool{
+		"/404.gep":    true,
+		"/500.gep":    true,
+		"/_error.gep": true,
+		"/999.gep":    false,
+		"/0404.gep":   false,
+		"/a/404.gep":  false,
+		"/index.gep":  false,
+	}
+	for path, exp := range cases {
+		if act := isErrorPage(path); act != exp {
+			t.Errorf("isErrorPage(%q): expected %v, but got %v", path, exp, act)
+		}
+	}
+}
+
+func TestPage(t *testing.T) {
+	req := httptest.NewRequest("POST", "/a.gep?q=1&f=2", strings.NewReader("f=3"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: "sid", Value: "abc"})
+	rec := httptest.NewRecorder()
+	func() {
+		page := __newPage__(rec, req, 4096)
+		defer page.finish()
+
+		if act := page.Param("q"); act != "1" {
+			t.Errorf("Param(q): expected %q, but got %q", "1", act)
+		}
+		if act := page.Form("f"); act != "3" {
+			t.Errorf("Form(f): expected %q, but got %q", "3", act)
+		}
+		if act := page.Cookie("sid"); act != "abc" {
+			t.Errorf("Cookie(sid): expected %q, but got %q", "abc", act)
+		}
+		if act := page.Cookie("none"); act != "" {
+			t.Errorf("Cookie(none): expected empty, but got %q", act)
+		}
+		if page.Context() != req.Context() {
+			t.Errorf("Context() should be the context of the request")
+		}
+
+		page.SetCookie(&http.Cookie{Name: "sid", Value: "def"})
+		page.Status(http.StatusCreated)
+		page.JSON(map[string]int{"a": 1})
+		page.Abort()
+		__print__(page, "not reached")
+	}()
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("Expected status %d, but got %d", http.StatusCreated, rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+	if c := rec.Header().Get("Set-Cookie"); c != "sid=def" {
+		t.Errorf("Unexpected Set-Cookie %q", c)
+	}
+	if body := rec.Body.String(); body != "{\"a\":1}\n" {
+		t.Errorf("Unexpected body %q", body)
+	}
+}
+
+func TestRegisterPath_middlewares(t *testing.T) {
+	var trace []string
+	mw := func(name string, pass bool) middleware {
+		return middleware{"/" + name + "/_middleware.gep", func(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+			trace = append(trace, name)
+			if pass {
+				next(w, r)
+			} else {
+				http.Error(w, "denied", http.StatusForbidden)
+			}
+		}}
+	}
+	page := func(w http.ResponseWriter, r *http.Request) {
+		trace = append(trace, "page")
+	}
+	defer delete(processors, "/mw/a.gep")
+	defer delete(routes, "/mw/a.gep")
+
+	registerPath("/mw/a.gep", page, mw("a", true), mw("b", true))
+	processors["/mw/a.gep"](httptest.NewRecorder(), httptest.NewRequest("GET", "/mw/a.gep", nil))
+	if s := strings.Join(trace, " "); s != "a b page" {
+		t.Errorf("Expected a b page, but got %s", s)
+	}
+	if mws := strings.Join(routes["/mw/a.gep"], " "); mws != "/a/_middleware.gep /b/_middleware.gep" {
+		t.Errorf("Unexpected route: %s", mws)
+	}
+
+	trace = nil
+	registerPath("/mw/a.gep", page, mw("a", false), mw("b", true))
+	rec := httptest.NewRecorder()
+	processors["/mw/a.gep"](rec, httptest.NewRequest("GET", "/mw/a.gep", nil))
+	if s := strings.Join(trace, " "); s != "a" || rec.Code != http.StatusForbidden {
+		t.Errorf("Expected short-circuited by a, but got %s, %d", s, rec.Code)
+	}
+}
+
+func TestRegisterPath_errorPage(t *testing.T) {
+	// a middleware stopping requests by Error, whose error page is under it
+	auth := middleware{"/_middleware.gep", func(response http.ResponseWriter, request *http.Request, next http.HandlerFunc) {
+		__response__ := __newPage__(response, request, 4096)
+		defer __response__.finish()
+		if __response__.Param("deny") != "" {
+			Error(http.StatusForbidden, nil)
+		}
+		next(__response__, request)
+	}}
+	registerPath("/_error.gep", func(response http.ResponseWriter, request *http.Request) {
+		__response__ := __newPage__(response, request, 4096)
+		defer __response__.finish()
+		__print__(__response__, fmt.Sprintf("error %d", GetError(request).Status))
+	}, auth)
+	registerPath("/mw/b.gep", func(response http.ResponseWriter, request *http.Request) {
+		__response__ := __newPage__(response, request, 4096)
+		defer __response__.finish()
+		__print__(__response__, "page")
+	}, auth)
+	defer func() {
+		for _, path := range []string{"/_error.gep", "/mw/b.gep"} {
+			delete(processors, path)
+			delete(routes, path)
+		}
+	}()
+
+	if mws := routes["/_error.gep"]; len(mws) != 0 {
+		t.Errorf("Expected the error page not wrapped, but got %v", mws)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/mw/b.gep?deny=1", nil))
+	if rec.Code != http.StatusForbidden || rec.Body.String() != "error 403" {
+		t.Errorf("Expected 403 %q, but got %d %q", "error 403", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/mw/b.gep", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "page" {
+		t.Errorf("Expected 200 %q, but got %d %q", "page", rec.Code, rec.Body.String())
+	}
+}
+
+func TestApp(t *testing.T) {
+	defer func() { appStarts = nil }()
+
+	var trace []string
+	a := &App{}
+	registerApp(func(app *App) error {
+		app.Set("db", "conn")
+		app.OnStop(func(app *App) error {
+			trace = append(trace, "close "+app.Get("db").(string))
+			return nil
+		})
+		app.OnStop(func(app *App) error {
+			trace = append(trace, "flush")
+			return errors.New("failed")
+		})
+		return nil
+	})
+	if err := a.start(); err != nil {
+		t.Fatal(err)
+	}
+	if v := a.Get("db"); v != "conn" {
+		t.Errorf("Expected conn, but got %v", v)
+	}
+	a.stop()
+	a.stop()
+	if s := strings.Join(trace, ", "); s != "flush, close conn" {
+		t.Errorf("Unexpected stop hooks called: %s", s)
+	}
+
+	appStarts = nil
+	registerApp(func(app *App) error {
+		panic("no config")
+	})
+	if err := a.start(); err == nil || !strings.Contains(err.Error(), "no config") {
+		t.Errorf("Expected error of the panic, but got %v", err)
 	}
 }
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/daviddengcn/go-villa"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// module path of the back server if the site has no go.mod
+	s_SITE_MODULE = "geps/site"
+	// minimum go version of the back server, gepsvr.go uses generics
+	s_GO_VERSION = "1.18"
+
+	// folder in the build folder holding the runtime packages of geps. It
+	// starts with '_' so the go command ignores it in patterns like ./...
+	fn_RUNTIME_DIR = "_geps"
+	fn_GO_MOD      = "go.mod"
+	fn_GO_SUM      = "go.sum"
+	fn_VENDOR      = "vendor"
+	fn_MODULES_TXT = "modules.txt"
+)
+
+// runtimeRequires are the modules required by gepsvr.go, with the go.sum
+// lines following the version, so that the back server builds offline from
+// the module cache.
+var runtimeRequires = []struct {
+	path, version string
+	sums          []string
+}{
+	{"github.com/russross/blackfriday", "v1.6.0", []string{
+		" h1:KqfZb0pUVN2lYqZUYRddxF4OR8ZMURnJIG5Y3VRLtww=",
+		"/go.mod h1:ti0ldHuxg49ri4ksnFxlkCfN+hvslNlmVHqNRXXJNAY=",
+	}},
+}
+
+// Environment variables of go commands, e.g. GOFLAGS=-mod=mod and
+// GOPROXY=off for offline builds.
+var gGoEnv []string
+
+// goCommand returns a go command running in dir with gGoEnv
+func goCommand(dir villa.Path, args ...string) *exec.Cmd {
+	cmd := villa.Path("go").Command(args...)
+	cmd.Dir = dir.S()
+	cmd.Env = append(os.Environ(), gGoEnv...)
+	return cmd
+}
+
+// goMod is the part of "go mod edit -json" output used by writeGoMod
+type goMod struct {
+	Go      string
+	Require []struct {
+		Path, Version string
+	}
+	Replace []struct {
+		Old, New struct {
+			Path, Version string
+		}
+	}
+}
+
+// siteDir returns the folder of the go.mod, go.sum and vendor of the site
+func (m *monitor) siteDir() villa.Path {
+	if m.libDir != "" {
+		return m.libDir
+	}
+	return m.webDir
+}
+
+// writeGoMod writes go.mod and go.sum into the build folder dir, and the
+// runtime packages into dir/_geps. The go.mod of the site is used as a base
+// if exists. Requirements of the runtime are added unless the site requires
+// them, relative replacements are made absolute, and the vendor folder of the
+// site is copied with the runtime modules added.
+func (m *monitor) writeGoMod(dir villa.Path) error {
+	siteDir := m.siteDir()
+	if _, err := siteDir.Join(fn_GO_MOD).Stat(); err == nil {
+		if err := copyFile(siteDir.Join(fn_GO_MOD), dir.Join(fn_GO_MOD)); err != nil {
+			return err
+		}
+	} else {
+		src := "module " + s_SITE_MODULE + "\n\ngo " + s_GO_VERSION + "\n"
+		if err := dir.Join(fn_GO_MOD).WriteFile([]byte(src), 0666); err != nil {
+			return err
+		}
+	}
+	dir.Join(fn_GO_SUM).Remove()
+	if err := copyFile(siteDir.Join(fn_GO_SUM), dir.Join(fn_GO_SUM)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	out, err := goCommand(dir, "mod", "edit", "-json").Output()
+	if err != nil {
+		log.Println("Reading", dir.Join(fn_GO_MOD), "failed:", err)
+		return err
+	}
+	var mod goMod
+	if err := json.Unmarshal(out, &mod); err != nil {
+		return err
+	}
+
+	required := villa.NewStrSet()
+	for _, req := range mod.Require {
+		required.Put(req.Path)
+	}
+	args := []string{"mod", "edit"}
+	if versionLess(mod.Go, s_GO_VERSION) {
+		args = append(args, "-go="+s_GO_VERSION)
+	}
+	var sums bytes.Buffer
+	for _, req := range runtimeRequires {
+		if required.In(req.path) {
+			continue
+		}
+		args = append(args, "-require="+req.path+"@"+req.version)
+		for _, sum := range req.sums {
+			sums.WriteString(req.path + " " + req.version + sum + "\n")
+		}
+	}
+	if !required.In(GEPS_PKG_PATH) {
+		args = append(args, "-require="+GEPS_PKG_PATH+"@v0.0.0")
+	}
+	args = append(args, "-replace="+GEPS_PKG_PATH+"=./"+fn_RUNTIME_DIR)
+	for _, rep := range mod.Replace {
+		if !strings.HasPrefix(rep.New.Path, "./") && !strings.HasPrefix(rep.New.Path, "../") {
+			continue
+		}
+		old := rep.Old.Path
+		if rep.Old.Version != "" {
+			old += "@" + rep.Old.Version
+		}
+		args = append(args, "-replace="+old+"="+siteDir.Join(rep.New.Path).S())
+	}
+	if out, err := goCommand(dir, args...).CombinedOutput(); err != nil {
+		log.Printf("Editing %v failed: %v\n%s", dir.Join(fn_GO_MOD), err, out)
+		return err
+	}
+
+	if sums.Len() > 0 {
+		f, err := os.OpenFile(dir.Join(fn_GO_SUM).S(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(sums.Bytes())
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := m.writeRuntime(dir.Join(fn_RUNTIME_DIR)); err != nil {
+		return err
+	}
+
+	versions := make(map[string]string)
+	for _, req := range runtimeRequires {
+		versions[req.path] = req.version
+	}
+	for _, req := range mod.Require {
+		versions[req.Path] = req.Version
+	}
+	return m.writeVendor(dir, versions)
+}
+
+// writeVendor writes the vendor folder of the build folder dir if the site
+// has one, which the go command uses by default. It is a copy of that of the
+// site with the runtime modules added, so that vendor/modules.txt is
+// consistent with the go.mod written. versions are the required versions of
+// modules by paths.
+func (m *monitor) writeVendor(dir villa.Path, versions map[string]string) error {
+	vendor := dir.Join(fn_VENDOR)
+	if err := vendor.RemoveAll(); err != nil {
+		return err
+	}
+	siteVendor := m.siteDir().Join(fn_VENDOR)
+	if !siteVendor.IsDir() {
+		return nil
+	}
+	if err := copyDir(siteVendor, vendor); err != nil {
+		return err
+	}
+	data, err := vendor.Join(fn_MODULES_TXT).ReadFile()
+	if err != nil {
+		return err
+	}
+	mt := modulesTxt(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+	mt.absReplacements(m.siteDir())
+
+	for _, req := range runtimeRequires {
+		pkgDir := vendor.Join(req.path)
+		if mt.hasPackage(req.path, req.path) && pkgDir.IsDir() {
+			continue
+		}
+		version := versions[req.path]
+		src, err := moduleCacheDir(dir, req.path, version)
+		if err != nil {
+			log.Println("Vendoring", req.path, "failed:", err)
+			return err
+		}
+		mt = mt.addPackage(req.path, req.path, "# "+req.path+" "+version,
+			"## explicit; go "+goVersionOf(src.Join(fn_GO_MOD)))
+		if err := copyPackage(src, pkgDir); err != nil {
+			return err
+		}
+	}
+	// the runtime packages, replaced with the folder written by writeRuntime.
+	// The replacement of all versions is listed at last.
+	mt = mt.addPackage(GEPS_PKG_PATH, GEPS_PKG_PATH+"/utils",
+		"# "+GEPS_PKG_PATH+" v0.0.0 => ./"+fn_RUNTIME_DIR, "## explicit; go "+s_GO_VERSION)
+	if replace := "# " + GEPS_PKG_PATH + " => ./" + fn_RUNTIME_DIR; mt[len(mt)-1] != replace {
+		mt = append(mt, replace)
+	}
+	if err := copyPackage(dir.Join(fn_RUNTIME_DIR, "utils"), vendor.Join(GEPS_PKG_PATH, "utils")); err != nil {
+		return err
+	}
+
+	return vendor.Join(fn_MODULES_TXT).WriteFile([]byte(strings.Join(mt, "\n")+"\n"), 0666)
+}
+
+// modulesTxt is vendor/modules.txt by lines. A module is listed as a
+// "# path version [=> replacement]" line, followed by "## " annotation lines
+// and the lines of its packages vendored.
+type modulesTxt []string
+
+// module returns the index of the line of the module of path, -1 if not
+// found.
+func (mt modulesTxt) module(path string) int {
+	for i, line := range mt {
+		if f := strings.Fields(line); len(f) >= 2 && f[0] == "#" && f[1] == path {
+			return i
+		}
+	}
+	return -1
+}
+
+// hasPackage returns true if pkg is listed in the module of path
+func (mt modulesTxt) hasPackage(path, pkg string) bool {
+	i := mt.module(path)
+	if i < 0 {
+		return false
+	}
+	for _, line := range mt[i+1:] {
+		if strings.HasPrefix(line, "# ") {
+			break
+		}
+		if line == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// addPackage lists pkg in the module of path. The module is added with the
+// header lines if not listed.
+func (mt modulesTxt) addPackage(path, pkg string, header ...string) modulesTxt {
+	if mt.hasPackage(path, pkg) {
+		return mt
+	}
+	i := mt.module(path)
+	if i < 0 {
+		return append(append(mt, header...), pkg)
+	}
+	// after the annotations of the module
+	for i++; i < len(mt) && strings.HasPrefix(mt[i], "## "); i++ {
+	}
+	return append(mt[:i], append(modulesTxt{pkg}, mt[i:]...)...)
+}
+
+// absReplacements makes relative replacements absolute to siteDir, as
+// writeGoMod does in go.mod.
+func (mt modulesTxt) absReplacements(siteDir villa.Path) {
+	for i, line := range mt {
+		if !strings.HasPrefix(line, "# ") {
+			continue
+		}
+		f := strings.Fields(line)
+		for j := 0; j+1 < len(f); j++ {
+			if f[j] == "=>" && (strings.HasPrefix(f[j+1], "./") || strings.HasPrefix(f[j+1], "../")) {
+				f[j+1] = siteDir.Join(f[j+1]).S()
+				mt[i] = strings.Join(f, " ")
+			}
+		}
+	}
+}
+
+// moduleCacheDir returns the folder of the module of path at version in the
+// module cache.
+func moduleCacheDir(dir villa.Path, path, version string) (villa.Path, error) {
+	out, err := goCommand(dir, "env", "GOMODCACHE").Output()
+	if err != nil {
+		return "", err
+	}
+	var escaped strings.Builder
+	for _, r := range path + "@" + version {
+		// upper case letters are escaped as '!' followed by the lower case
+		if 'A' <= r && r <= 'Z' {
+			escaped.WriteByte('!')
+			r += 'a' - 'A'
+		}
+		escaped.WriteRune(r)
+	}
+	src := villa.Path(strings.TrimSpace(string(out))).Join(escaped.String())
+	if !src.IsDir() {
+		return "", fmt.Errorf("%s@%s not in the module cache", path, version)
+	}
+	return src, nil
+}
+
+// goVersionOf returns the go version in a go.mod file, empty if not found
+func goVersionOf(goMod villa.Path) string {
+	data, err := goMod.ReadFile()
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if f := strings.Fields(line); len(f) == 2 && f[0] == "go" {
+			return f[1]
+		}
+	}
+	return ""
+}
+
+// copyPackage copies the files of a package, other than tests and sub
+// folders, from src to dst as the go command vendors it.
+func copyPackage(src, dst villa.Path) error {
+	infos, err := src.ReadDir()
+	if err != nil {
+		return err
+	}
+	if err := dst.MkdirAll(0777); err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasSuffix(name, s_TEST_SUFFIX) || name == fn_GO_MOD || name == fn_GO_SUM {
+			continue
+		}
+		if err := copyFile(src.Join(name), dst.Join(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyDir copies the folder src to dst recursively
+func copyDir(src, dst villa.Path) error {
+	return src.Walk(func(path villa.Path, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := src.Rel(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return dst.Join(rel).MkdirAll(0777)
+		}
+		return copyFile(path, dst.Join(rel))
+	})
+}
+
+// writeRuntime writes the module of the runtime packages imported by
+// gepsvr.go into dir.
+func (m *monitor) writeRuntime(dir villa.Path) error {
+	if err := dir.Join("utils").MkdirAll(0777); err != nil {
+		return err
+	}
+	mod := "module " + GEPS_PKG_PATH + "\n\ngo " + s_GO_VERSION + "\n"
+	if err := dir.Join(fn_GO_MOD).WriteFile([]byte(mod), 0666); err != nil {
+		return err
+	}
+	for _, fn := range embedUtils {
+		src, err := runtimeFS.ReadFile(fn)
+		if err != nil {
+			return err
+		}
+		if err := writeIfChanged(dir.Join(fn), src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionLess returns true if go version a, e.g. "1.9", is less than b. An
+// empty version is less than any others.
+func versionLess(a, b string) bool {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, _ := strconv.Atoi(as[i])
+		bn, _ := strconv.Atoi(bs[i])
+		if an != bn {
+			return an < bn
+		}
+	}
+	return len(as) < len(bs)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/daviddengcn/go-villa"
+	"strings"
+	"testing"
+)
+
+func TestVersionLess(t *testing.T) {
+	cases := []struct {
+		a, b string
+		less bool
+	}{
+		{"1.16", "1.18", true},
+		{"1.18", "1.18", false},
+		{"1.21.0", "1.18", false},
+		{"1.9", "1.18", true},
+		{"", "1.18", true},
+	}
+	for _, c := range cases {
+		if less := versionLess(c.a, c.b); less != c.less {
+			t.Errorf("versionLess(%q, %q): expected %v, but got %v", c.a, c.b, c.less, less)
+		}
+	}
+}
+
+func TestWriteGoMod(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_gomod_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	site, out := root.Join("site"), root.Join("out")
+	site.MkdirAll(0777)
+	out.MkdirAll(0777)
+	site.Join(fn_GO_MOD).WriteFile([]byte(`module mysite
+
+go 1.16
+
+require github.com/russross/blackfriday v1.5.2
+
+replace example.com/lib => ../lib
+`), 0666)
+	site.Join(fn_GO_SUM).WriteFile([]byte("example.com/x v1.0.0 h1:x=\n"), 0666)
+
+	m := &monitor{webDir: site}
+	if err := m.writeGoMod(out); err != nil {
+		t.Fatal(err)
+	}
+
+	js, err := goCommand(out, "mod", "edit", "-json").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mod goMod
+	if err := json.Unmarshal(js, &mod); err != nil {
+		t.Fatal(err)
+	}
+	if mod.Go != s_GO_VERSION {
+		t.Errorf("Expected go %s, but got %s", s_GO_VERSION, mod.Go)
+	}
+	requires := map[string]string{}
+	for _, req := range mod.Require {
+		requires[req.Path] = req.Version
+	}
+	if v := requires["github.com/russross/blackfriday"]; v != "v1.5.2" {
+		t.Errorf("Expected blackfriday of the site kept, but got %q", v)
+	}
+	if _, ok := requires[GEPS_PKG_PATH]; !ok {
+		t.Errorf("Expected %s required", GEPS_PKG_PATH)
+	}
+	replaces := map[string]string{}
+	for _, rep := range mod.Replace {
+		replaces[rep.Old.Path] = rep.New.Path
+	}
+	if r := replaces[GEPS_PKG_PATH]; r != "./"+fn_RUNTIME_DIR {
+		t.Errorf("Expected %s replaced by ./%s, but got %q", GEPS_PKG_PATH, fn_RUNTIME_DIR, r)
+	}
+	if r := replaces["example.com/lib"]; r != root.Join("lib").S() {
+		t.Errorf("Expected relative replacement made absolute, but got %q", r)
+	}
+
+	sum, _ := out.Join(fn_GO_SUM).ReadFile()
+	if !strings.Contains(string(sum), "example.com/x v1.0.0 h1:x=") {
+		t.Errorf("Expected go.sum of the site copied, but got %s", sum)
+	}
+	for _, fn := range embedUtils {
+		if _, err := out.Join(fn_RUNTIME_DIR, fn).Stat(); err != nil {
+			t.Errorf("Expected runtime written: %v", err)
+		}
+	}
+}
+
+func TestWriteGoMod_vendor(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_gomod_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+	root = root.AbsPath()
+	if _, err := moduleCacheDir(root, "github.com/russross/blackfriday", "v1.6.0"); err != nil {
+		t.Skip("Runtime modules not in the module cache:", err)
+	}
+
+	site, out := root.Join("site"), root.Join("out")
+	files := map[string]string{
+		"dep/go.mod": "module example.com/dep\n\ngo 1.18\n",
+		"dep/dep.go": "package dep\n\nfunc X() int { return 1 }\n",
+		"site/go.mod": "module mysite\n\ngo 1.21\n\nrequire example.com/dep v1.0.0\n\n" +
+			"replace example.com/dep v1.0.0 => ../dep\n",
+		"site/vendor/modules.txt":            "# example.com/dep v1.0.0 => ../dep\n## explicit; go 1.18\nexample.com/dep\n",
+		"site/vendor/example.com/dep/dep.go": "package dep\n\nfunc X() int { return 1 }\n",
+		"out/main.go": `package main
+
+import (
+	"example.com/dep"
+	"github.com/daviddengcn/geps/utils"
+	"github.com/russross/blackfriday"
+)
+
+var _ = utils.HTMLEscapeString
+var _ = blackfriday.MarkdownBasic
+
+func main() { println(dep.X()) }
+`,
+	}
+	for fn, src := range files {
+		root.Join(fn).Dir().MkdirAll(0777)
+		if err := root.Join(fn).WriteFile([]byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := &monitor{webDir: site}
+	if err := m.writeGoMod(out); err != nil {
+		t.Fatal(err)
+	}
+	txt, _ := out.Join(fn_VENDOR, fn_MODULES_TXT).ReadFile()
+	if !strings.Contains(string(txt), "# example.com/dep v1.0.0 => "+root.Join("dep").S()) {
+		t.Errorf("Expected the relative replacement made absolute, but got\n%s", txt)
+	}
+	if !site.Join(fn_VENDOR, fn_MODULES_TXT).Exists() || site.Join(fn_VENDOR, "github.com").Exists() {
+		t.Errorf("Expected the vendor folder of the site untouched")
+	}
+
+	// builds offline from the vendor folder
+	cmd := goCommand(out, "build", "-o", root.Join("site.exe").S())
+	cmd.Env = append(cmd.Env, "GOFLAGS=-mod=vendor", "GOPROXY=off")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("Building with vendor failed: %v\n%s\n%s", err, output, txt)
+	}
+}
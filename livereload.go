@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/daviddengcn/go-villa"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseEvent is a Server-Sent Event for browsers in development mode
+type sseEvent struct {
+	name, data string
+}
+
+const (
+	// the back server switched to a new generation, pages reload
+	s_EVENT_SWITCHED = "switched"
+	// CSS files changed, data is a JSON list of their paths
+	s_EVENT_CSS = "css"
+)
+
+// Seconds between keep-alive comments of the event stream
+var gEventKeepAlive time.Duration = 30
+
+// broadcaster sends events to all subscribed clients
+type broadcaster struct {
+	mu      sync.Mutex
+	clients map[chan sseEvent]struct{}
+}
+
+// Events to the browsers in development mode
+var gEvents broadcaster
+
+func (b *broadcaster) subscribe() chan sseEvent {
+	ch := make(chan sseEvent, 8)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.clients == nil {
+		b.clients = make(map[chan sseEvent]struct{})
+	}
+	b.clients[ch] = struct{}{}
+	return ch
+}
+
+func (b *broadcaster) unsubscribe(ch chan sseEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.clients, ch)
+}
+
+// broadcast sends ev to all clients. A client too slow to receive misses
+// the event rather than blocking others.
+func (b *broadcaster) broadcast(ev sseEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.clients {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// handleEvents is the Server-Sent Events endpoint of the live reload
+// script, in development mode only.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if gMode != "dev" || !ok {
+		http.NotFound(w, r)
+		return
+	}
+	ch := gEvents.subscribe()
+	defer gEvents.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, ": connected\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(gEventKeepAlive * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case ev := <-ch:
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, ev.data)
+		}
+		flusher.Flush()
+	}
+}
+
+// broadcastCSS sends the css event if some of the changed paths are CSS
+// files under the web root, so that browsers reload the style sheets only.
+func broadcastCSS(web villa.Path, paths []string) {
+	var urls []string
+	for _, path := range paths {
+		if strings.ToLower(filepath.Ext(path)) != ".css" {
+			continue
+		}
+		rel, err := filepath.Rel(web.S(), path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		urls = append(urls, "/"+filepath.ToSlash(rel))
+	}
+	if len(urls) == 0 {
+		return
+	}
+	data, _ := json.Marshal(urls)
+	log.Println("CSS changed:", urls)
+	gEvents.broadcast(sseEvent{name: s_EVENT_CSS, data: string(data)})
+}
+
+// liveReloadScript is injected into HTML pages in development mode
+const liveReloadScript = `<script>
+(function() {
+	var events = new EventSource("/__geps/events");
+	events.addEventListener("` + s_EVENT_SWITCHED + `", function() {
+		location.reload();
+	});
+	events.addEventListener("` + s_EVENT_CSS + `", function(e) {
+		var paths = JSON.parse(e.data);
+		var links = document.querySelectorAll('link[rel="stylesheet"]');
+		for (var i = 0; i < links.length; i++) {
+			var url = new URL(links[i].href, location.href);
+			if (url.origin == location.origin && paths.indexOf(url.pathname) >= 0) {
+				url.searchParams.set("__geps", Date.now());
+				links[i].href = url.href;
+			}
+		}
+	});
+})();
+</script>
+`
+
+// injectScript inserts the live reload script before </body>, or appends it
+// if not found.
+func injectScript(html []byte) []byte {
+	i := lastIndexFold(html, []byte("</body>"))
+	if i < 0 {
+		return append(html, liveReloadScript...)
+	}
+	out := make([]byte, 0, len(html)+len(liveReloadScript))
+	out = append(out, html[:i]...)
+	out = append(out, liveReloadScript...)
+	return append(out, html[i:]...)
+}
+
+// lastIndexFold returns the index of the last instance of the ASCII sep in s
+// ignoring case, or -1 if not present. Lowering s instead may change the
+// lengths of non-ASCII characters, and so the index.
+func lastIndexFold(s, sep []byte) int {
+	for i := len(s) - len(sep); i >= 0; i-- {
+		if bytes.EqualFold(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isHTML returns true if resp is an uncompressed HTML page
+func isHTML(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") &&
+		resp.Header.Get("Content-Encoding") == ""
+}
+
+// copyHTMLResponse copies an HTML page of the back server to w with the
+// live reload script injected.
+func copyHTMLResponse(w http.ResponseWriter, resp *http.Response) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("Reading response of back server:", err)
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(injectScript(body))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInjectScript(t *testing.T) {
+	html := string(injectScript([]byte("<html><BODY>hi</BODY></html>")))
+	if !strings.HasSuffix(html, liveReloadScript+"</BODY></html>") {
+		t.Errorf("Expected the script before </BODY>, but got %q", html)
+	}
+	// lowering İ makes it longer
+	html = string(injectScript([]byte("<body>İİİ</Body>")))
+	if html != "<body>İİİ"+liveReloadScript+"</Body>" {
+		t.Errorf("Expected the script before </Body>, but got %q", html)
+	}
+	if html := string(injectScript([]byte("hi"))); html != "hi"+liveReloadScript {
+		t.Errorf("Expected the script appended, but got %q", html)
+	}
+}
+
+func TestBroadcastCSS(t *testing.T) {
+	ch := gEvents.subscribe()
+	defer gEvents.unsubscribe(ch)
+
+	broadcastCSS("/site/web", []string{"/site/web/a.gep", "/site/web/css/main.CSS", "/site/other.css"})
+	select {
+	case ev := <-ch:
+		if ev.name != s_EVENT_CSS || ev.data != `["/css/main.CSS"]` {
+			t.Errorf("Unexpected event: %+v", ev)
+		}
+	default:
+		t.Fatal("Expected a css event")
+	}
+
+	broadcastCSS("/site/web", []string{"/site/web/a.gep"})
+	select {
+	case ev := <-ch:
+		t.Errorf("Expected no event, but got %+v", ev)
+	default:
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	defer func(mode string) { gMode = mode }(gMode)
+	gMode = "dev"
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, but got %s", ct)
+	}
+	rd := bufio.NewReader(resp.Body)
+	// the comment sent on connection, after the client subscribed
+	if line, _ := rd.ReadString('\n'); line != ": connected\n" {
+		t.Fatalf("Unexpected first line: %q", line)
+	}
+	rd.ReadString('\n')
+
+	gEvents.broadcast(sseEvent{name: s_EVENT_SWITCHED, data: "localhost:8082"})
+	lines := make(chan string)
+	go func() {
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	var got []string
+	for len(got) < 2 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected an event, but got %q", got)
+		}
+	}
+	if s := strings.Join(got, ""); s != "event: switched\ndata: localhost:8082\n" {
+		t.Errorf("Unexpected event: %q", s)
+	}
+
+	gMode = "prod"
+	rec := httptest.NewRecorder()
+	handleEvents(rec, httptest.NewRequest("GET", "/__geps/events", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 in production mode, but got %d", rec.Code)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/daviddengcn/go-villa"
+	"os"
+	"sort"
+	"strings"
+)
+
+// suffix of the manifest file of an executable
+const s_MANIFEST_SUFFIX = ".manifest"
+
+// keys of inputs embedded in geps in a manifest, which are not files
+const (
+	s_EMBEDDED_PREFIX  = "embedded:"
+	s_EMBEDDED_RUNTIME = s_EMBEDDED_PREFIX + fn_EMBED_GEPSVR
+	// the generator of page sources, by its version and template
+	s_EMBEDDED_GENERATOR = s_EMBEDDED_PREFIX + "generator"
+)
+
+// manifestEntry is the size and the content hash of an input file
+type manifestEntry struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// manifest maps paths of all inputs of a build to their entries. A path
+// missing on disk has an empty entry.
+type manifest map[string]manifestEntry
+
+// equals returns true if both manifests have the same inputs and contents
+func (mf manifest) equals(other manifest) bool {
+	if len(mf) != len(other) {
+		return false
+	}
+	for path, e := range mf {
+		if o, ok := other[path]; !ok || o != e {
+			return false
+		}
+	}
+	return true
+}
+
+// diff returns the sorted paths added, removed or changed in mf compared to
+// old.
+func (mf manifest) diff(old manifest) (paths []string) {
+	for path, e := range mf {
+		if o, ok := old[path]; !ok || o != e {
+			paths = append(paths, path)
+		}
+	}
+	for path := range old {
+		if _, ok := mf[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// loadManifest reads the manifest saved by saveManifest, nil if not found
+func loadManifest(path villa.Path) manifest {
+	data, err := path.ReadFile()
+	if err != nil {
+		return nil
+	}
+	var mf manifest
+	if err := json.Unmarshal(data, &mf); err != nil {
+		return nil
+	}
+	return mf
+}
+
+// save writes the manifest into path in JSON
+func (mf manifest) save(path villa.Path) error {
+	data, err := json.MarshalIndent(mf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return path.WriteFile(data, 0666)
+}
+
+// hashEntry is a cached manifestEntry of a file with its signature
+type hashEntry struct {
+	sig   fileSig
+	entry manifestEntry
+}
+
+// contentEntry returns the manifestEntry of data
+func contentEntry(data []byte) manifestEntry {
+	sum := sha256.Sum256(data)
+	return manifestEntry{Size: int64(len(data)), SHA256: hex.EncodeToString(sum[:])}
+}
+
+// hashFile returns the manifestEntry of a file. Hashes are cached and
+// computed again only if the size or the modification time changed.
+func (m *monitor) hashFile(path villa.Path) manifestEntry {
+	info, err := path.Stat()
+	if err != nil {
+		delete(m.hashes, path.S())
+		return manifestEntry{}
+	}
+	sig := fileSig{size: info.Size(), modTime: info.ModTime()}
+	if h, ok := m.hashes[path.S()]; ok && h.sig == sig {
+		return h.entry
+	}
+
+	data, err := path.ReadFile()
+	if err != nil {
+		return manifestEntry{}
+	}
+	e := contentEntry(data)
+	if m.hashes == nil {
+		m.hashes = make(map[string]hashEntry)
+	}
+	m.hashes[path.S()] = hashEntry{sig: sig, entry: e}
+	return e
+}
+
+// inputManifest returns the manifest of all inputs of a build: GEP files and
+// their dependencies, with empty entries of missing ones, .go files, go.mod
+// and go.sum of the site, the runtime, the generator and the configuration
+// file. Inputs embedded in geps are included, so that a build of an older
+// geps is not reused after upgrading. Paths in old are also included, so that
+// a dependency known only by the last build is still checked.
+func (m *monitor) inputManifest(files, libFiles map[villa.Path]os.FileInfo, old manifest) manifest {
+	mf := make(manifest)
+	for path := range old {
+		if !strings.HasPrefix(path, s_EMBEDDED_PREFIX) {
+			mf[path] = m.hashFile(villa.Path(path))
+		}
+	}
+	for path := range files {
+		p := m.webDir.Join(path)
+		mf[p.S()] = m.hashFile(p)
+	}
+	for _, st := range m.pages {
+		for path := range st.depends {
+			p := m.webDir.Join(path)
+			mf[p.S()] = m.hashFile(p)
+		}
+	}
+	for path := range libFiles {
+		mf[path.S()] = m.hashFile(path)
+	}
+	for _, fn := range []string{fn_GO_MOD, fn_GO_SUM} {
+		p := m.siteDir().Join(fn)
+		mf[p.S()] = m.hashFile(p)
+	}
+	if m.gepsvrFile != "" {
+		mf[m.gepsvrFile.S()] = m.hashFile(m.gepsvrFile)
+	} else if src, err := runtimeFS.ReadFile(fn_EMBED_GEPSVR); err == nil {
+		mf[s_EMBEDDED_RUNTIME] = contentEntry(src)
+	}
+	for _, fn := range embedUtils {
+		if src, err := runtimeFS.ReadFile(fn); err == nil {
+			mf[s_EMBEDDED_PREFIX+fn] = contentEntry(src)
+		}
+	}
+	mf[s_EMBEDDED_GENERATOR] = contentEntry([]byte(generatorVersion + "\n" + sTemplate.Tree.Root.String()))
+	if m.confFile != "" {
+		mf[m.confFile.S()] = m.hashFile(m.confFile)
+	}
+	return mf
+}
+
+// hash returns the SHA-256 of the manifest, identifying the inputs of a
+// build
+func (mf manifest) hash() string {
+	// keys of maps are encoded in sorted order
+	data, _ := json.Marshal(mf)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
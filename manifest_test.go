@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/daviddengcn/go-villa"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInputManifest(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_manifest_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+	root = root.AbsPath()
+
+	web := root.Join("web")
+	web.MkdirAll(0777)
+	web.Join("a.gep").WriteFile([]byte(`<%!include "a.md"%>`), 0666)
+	web.Join("b.gep").WriteFile([]byte(`b`), 0666)
+	web.Join("a.md").WriteFile([]byte(`*a*`), 0666)
+
+	m := &monitor{webDir: web, srcDir: root.Join("src")}
+	m.srcDir.MkdirAll(0777)
+	files := m.scanFiles()
+	if err := m.parse(srcNames(files)); err != nil {
+		t.Fatal(err)
+	}
+	old := m.inputManifest(files, nil, nil)
+	if _, ok := old[web.Join("a.md").S()]; !ok {
+		t.Errorf("Expected dependency a.md in the manifest: %v", old)
+	}
+	for _, key := range []string{s_EMBEDDED_RUNTIME, s_EMBEDDED_PREFIX + "utils/excerpt.go", s_EMBEDDED_GENERATOR} {
+		if e, ok := old[key]; !ok || e.SHA256 == "" {
+			t.Errorf("Expected %s in the manifest: %v", key, old)
+		}
+	}
+
+	path := root.Join("old.manifest")
+	if err := old.save(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := loadManifest(path); !loaded.equals(old) {
+		t.Errorf("Expected %v loaded, but got %v", old, loaded)
+	}
+
+	// a build of another generator is not reused
+	other := make(manifest)
+	for path, e := range old {
+		other[path] = e
+	}
+	other[s_EMBEDDED_GENERATOR] = contentEntry([]byte("0"))
+	if mf := (&monitor{webDir: web}).inputManifest(files, nil, other); mf.equals(other) {
+		t.Errorf("Expected changed by the generator")
+	}
+
+	// a new monitor does not know the dependencies until parsing
+	m = &monitor{webDir: web}
+	if mf := m.inputManifest(files, nil, old); !mf.equals(old) {
+		t.Errorf("Expected unchanged, but changed: %v", mf.diff(old))
+	}
+
+	// restored with an old modification time
+	oldTime := time.Now().Add(-time.Hour)
+	web.Join("a.md").WriteFile([]byte(`*b*`), 0666)
+	os.Chtimes(web.Join("a.md").S(), oldTime, oldTime)
+	// deleted
+	web.Join("b.gep").Remove()
+	files = m.scanFiles()
+	mf := m.inputManifest(files, nil, old)
+	expected := web.Join("a.md").S() + " " + web.Join("b.gep").S()
+	if diff := strings.Join(mf.diff(old), " "); diff != expected {
+		t.Errorf("Expected changes %s, but got %s", expected, diff)
+	}
+}
+
+func TestInputManifest_missing(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_manifest_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+	root = root.AbsPath()
+
+	web := root.Join("web")
+	web.MkdirAll(0777)
+	web.Join("a.gep").WriteFile([]byte(`<%!include "a.md"%>`), 0666)
+
+	m := &monitor{webDir: web, srcDir: root.Join("src")}
+	m.srcDir.MkdirAll(0777)
+	files := m.scanFiles()
+	if err := m.parse(srcNames(files)); err != nil {
+		t.Fatal(err)
+	}
+	old := m.inputManifest(files, nil, nil)
+	md := web.Join("a.md").S()
+	if e, ok := old[md]; !ok || e != (manifestEntry{}) {
+		t.Errorf("Expected an empty entry of missing a.md, but got %v, %v", e, ok)
+	}
+	if mf := m.inputManifest(files, nil, old); !mf.equals(old) {
+		t.Errorf("Expected unchanged while still missing, but changed: %v", mf.diff(old))
+	}
+
+	web.Join("a.md").WriteFile([]byte(`*a*`), 0666)
+	if diff := strings.Join(m.inputManifest(files, nil, old).diff(old), " "); diff != md {
+		t.Errorf("Expected change %s, but got %s", md, diff)
+	}
+}
+
+func TestManifestHash(t *testing.T) {
+	a := manifest{"/web/a.gep": {Size: 1, SHA256: "aa"}, "/web/b.gep": {Size: 2, SHA256: "bb"}}
+	b := manifest{"/web/b.gep": {Size: 2, SHA256: "bb"}, "/web/a.gep": {Size: 1, SHA256: "aa"}}
+	if a.hash() != b.hash() {
+		t.Errorf("Expected the same hash of the same inputs")
+	}
+	b["/web/b.gep"] = manifestEntry{Size: 2, SHA256: "cc"}
+	if a.hash() == b.hash() {
+		t.Errorf("Expected different hashes of changed inputs")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/daviddengcn/geps/utils"
+	"github.com/daviddengcn/go-villa"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// header marking responses of the build error overlay, so the page can
+// tell when the build is fixed
+const s_OVERLAY_HEADER = "X-Geps-Build-Failed"
+
+// overlayError is a diagnostic with source lines around it
+type overlayError struct {
+	buildError
+	Excerpt []utils.SourceLine
+}
+
+// readExcerpt returns lines around line in a GEP file under the web root.
+// Columns are not marked, since those of code in GEP files are not mapped
+// exactly by line directives.
+func readExcerpt(web villa.Path, file string, line, around int) []utils.SourceLine {
+	if !strings.HasSuffix(file, s_SUFFIX) || line <= 0 {
+		return nil
+	}
+	src, err := web.Join(file).ReadFile()
+	if err != nil {
+		return nil
+	}
+	return utils.Excerpt(src, line, around)
+}
+
+// serveBuildErrors responds to r with the overlay of the errors of a failed
+// build, in development mode. The page reloads itself once a build
+// succeeds.
+func serveBuildErrors(w http.ResponseWriter, r *http.Request, status *buildStatus) {
+	w.Header().Set(s_OVERLAY_HEADER, "1")
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.HasSuffix(strings.ToLower(r.URL.Path), ".json"+s_SUFFIX) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(struct {
+			Status  int          `json:"status"`
+			Message string       `json:"message"`
+			Errors  []buildError `json:"errors"`
+		}{http.StatusInternalServerError, "build failed", status.Errors})
+		return
+	}
+
+	errs := make([]overlayError, len(status.Errors))
+	for i, e := range status.Errors {
+		errs[i] = overlayError{buildError: e,
+			Excerpt: readExcerpt(gPaths.webRoot, e.File, e.Line, 3)}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	err := overlayTmpl.Execute(w, struct {
+		Time   string
+		Header string
+		Errors []overlayError
+	}{
+		Time:   status.Time.Format("2006-01-02 15:04:05"),
+		Header: s_OVERLAY_HEADER,
+		Errors: errs,
+	})
+	if err != nil {
+		log.Println("Rendering build errors:", err)
+	}
+}
+
+// overlayTmpl is the page of the errors of a failed build
+var overlayTmpl = template.Must(template.New("overlay").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8"/>
+<title>Build failed</title>
+<style>
+body { font-family: sans-serif; margin: 0; background: rgba(0, 0, 0, 0.85); color: #eee; }
+.overlay { margin: 2em; }
+h1 { color: #f66; }
+pre { background: #222; padding: 0.5em; overflow: auto; }
+.current { background: #633; font-weight: bold; }
+</style>
+</head>
+<body>
+<div class="overlay">
+<h1>Build failed</h1>
+<p>at {{.Time}}, the page reloads once the build succeeds.</p>
+{{range .Errors}}
+<h3>{{if .File}}{{.File}}:{{.Line}}{{if .Col}}:{{.Col}}{{end}}: {{end}}{{.Msg}}</h3>
+{{if .Excerpt}}<pre>{{range .Excerpt}}<span{{if .Current}} class="current"{{end}}>{{printf "%5d" .No}}  {{.Text}}</span>
+{{end}}</pre>{{end}}
+{{end}}
+</div>
+<script>
+setInterval(function() {
+	fetch(location.href, {method: "HEAD", cache: "no-store"}).then(function(resp) {
+		if (!resp.headers.get({{.Header}})) {
+			location.reload();
+		}
+	});
+}, 1000);
+</script>
+</body>
+</html>
+`))
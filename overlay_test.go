@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/daviddengcn/go-villa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadExcerpt(t *testing.T) {
+	web, err := villa.Path("").TempDir("geps_overlay_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.RemoveAll()
+	web.Join("a.gep").WriteFile([]byte("line 1\n\t<%= x %>\nline 3\nline 4\n"), 0666)
+
+	excerpt := readExcerpt(web, "a.gep", 2, 1)
+	if len(excerpt) != 3 {
+		t.Fatalf("Expected 3 lines, but got %+v", excerpt)
+	}
+	cur := excerpt[1]
+	if cur.No != 2 || !cur.Current || cur.Text != "\t<%= x %>" {
+		t.Errorf("Unexpected current line: %+v", cur)
+	}
+	if excerpt[0].Current {
+		t.Errorf("Expected line 1 not current: %+v", excerpt[0])
+	}
+
+	if excerpt := readExcerpt(web, "util.go", 2, 1); excerpt != nil {
+		t.Errorf("Expected no excerpt of a .go file, but got %+v", excerpt)
+	}
+}
+
+func TestServeBuildErrors(t *testing.T) {
+	web, err := villa.Path("").TempDir("geps_overlay_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.RemoveAll()
+	web.Join("a.gep").WriteFile([]byte("hello\n<%= undefinedX %>\n"), 0666)
+	defer func(root villa.Path) { gPaths.webRoot = root }(gPaths.webRoot)
+	gPaths.webRoot = web
+
+	status := &buildStatus{
+		Time:   time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+		Errors: []buildError{{File: "a.gep", Line: 2, Col: 5, Msg: "undefined: undefinedX"}},
+	}
+	rec := httptest.NewRecorder()
+	serveBuildErrors(rec, httptest.NewRequest("GET", "/a.gep", nil), status)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, but got %d", http.StatusInternalServerError, rec.Code)
+	}
+	if rec.Header().Get(s_OVERLAY_HEADER) == "" {
+		t.Errorf("Expected header %s", s_OVERLAY_HEADER)
+	}
+	body := rec.Body.String()
+	for _, s := range []string{"a.gep:2:5: undefined: undefinedX", "2024-05-06 07:08:09",
+		`<span class="current">    2  &lt;%= undefinedX %&gt;</span>`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("Expected %q in the overlay, but got\n%s", s, body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	serveBuildErrors(rec, httptest.NewRequest("GET", "/a.json.gep", nil), status)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Expected JSON for an API page, but got %s", ct)
+	}
+}
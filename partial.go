@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"github.com/daviddengcn/go-villa"
+	"go/format"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// buildError is a diagnostic of parsing or compiling at a position of a
+// source file. File is relative to the web root for GEP files.
+type buildError struct {
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+	Col  int    `json:"col,omitempty"`
+	Msg  string `json:"msg"`
+}
+
+func (e buildError) String() string {
+	switch {
+	case e.File == "":
+		return e.Msg
+	case e.Col > 0:
+		return e.File + ":" + strconv.Itoa(e.Line) + ":" + strconv.Itoa(e.Col) + ": " + e.Msg
+	}
+	return e.File + ":" + strconv.Itoa(e.Line) + ": " + e.Msg
+}
+
+// buildErrorRe matches a diagnostic line of the Go compiler or the GEP
+// parser, e.g. ./index.gep:3:29: undefined: x
+var buildErrorRe = regexp.MustCompile(`^(?:\./)?([^\s:][^:]*):(\d+)(?::(\d+))?: (.*)$`)
+
+// parseBuildErrors returns the diagnostics in the output of go build. Lines
+// not in the form of file:line[:col]: msg are ignored.
+func parseBuildErrors(out string) (errs []buildError) {
+	for _, line := range strings.Split(out, "\n") {
+		m := buildErrorRe.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil || m[4] == "too many errors" {
+			continue
+		}
+		e := buildError{File: m[1], Msg: m[4]}
+		e.Line, _ = strconv.Atoi(m[2])
+		e.Col, _ = strconv.Atoi(m[3])
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// buildFailure is the error of a failed go build with its diagnostics
+type buildFailure struct {
+	err    error
+	errors []buildError
+}
+
+func (f *buildFailure) Error() string {
+	return f.err.Error()
+}
+
+// startFailure is the error of a built back server failed to start, with
+// the last lines of its stderr
+type startFailure struct {
+	err    error
+	stderr []string
+}
+
+func (f *startFailure) Error() string {
+	return "back server failed to start: " + f.err.Error()
+}
+
+// errorsOf returns the diagnostics of an error of parsing, compiling or
+// starting
+func errorsOf(err error) []buildError {
+	if f, ok := err.(*buildFailure); ok && len(f.errors) > 0 {
+		return f.errors
+	}
+	if f, ok := err.(*startFailure); ok {
+		errs := []buildError{{Msg: f.Error()}}
+		for _, line := range f.stderr {
+			errs = append(errs, buildError{Msg: line})
+		}
+		return errs
+	}
+	if errs := parseBuildErrors(err.Error()); len(errs) > 0 {
+		return errs
+	}
+	return []buildError{{Msg: err.Error()}}
+}
+
+// buildStatus is the result of the last build of the compiling daemon
+type buildStatus struct {
+	Time time.Time `json:"time"`
+	OK   bool      `json:"ok"`
+	// Diagnostics of a failed build
+	Errors []buildError `json:"errors,omitempty"`
+	// Pages left out of a partial build, by path
+	Broken map[string][]buildError `json:"broken,omitempty"`
+}
+
+// Storing the *buildStatus of the last build
+var gBuildStatus villa.AtomicBox
+
+// brokenPage is a page failed to build in a partial build
+type brokenPage struct {
+	errors []buildError
+	// whether the source of the last good build is used, otherwise a stub
+	// handler
+	good bool
+}
+
+// newBrokenPage returns the brokenPage of src. The last good source is used
+// in production mode, if any.
+func (m *monitor) newBrokenPage(src string, errs []buildError) *brokenPage {
+	_, ok := m.good[src]
+	return &brokenPage{errors: errs, good: ok && !m.dev}
+}
+
+// pagesOfFile returns the pages in srcFiles that fail by a diagnostic in
+// file, i.e. the page itself and pages including it for a GEP file.
+func (m *monitor) pagesOfFile(file string, srcFiles map[string]villa.Path) (srcs []string) {
+	if strings.HasSuffix(file, s_GO_SUFFIX) {
+		// a generated source without line directives
+		if src := strings.TrimSuffix(file, s_GO_SUFFIX); srcFiles[src] != "" {
+			srcs = append(srcs, src)
+		}
+		return srcs
+	}
+	if !strings.HasSuffix(file, s_SUFFIX) {
+		return nil
+	}
+	rel := villa.Path(filepath.Clean(file))
+	for src, path := range srcFiles {
+		if path == rel {
+			srcs = append(srcs, src)
+		} else if st := m.pages[src]; st != nil {
+			if _, ok := st.depends[rel]; ok {
+				srcs = append(srcs, src)
+			}
+		}
+	}
+	return srcs
+}
+
+// markBroken marks pages failing by errs as broken. A broken page using the
+// last good source falls back to a stub. It returns false if some errors
+// are not of a page, or no more pages can be left out, i.e. the build
+// cannot succeed partially.
+func (m *monitor) markBroken(broken map[string]*brokenPage, srcFiles map[string]villa.Path, errs []buildError) bool {
+	pages := make(map[string][]buildError)
+	for _, e := range errs {
+		srcs := m.pagesOfFile(e.File, srcFiles)
+		if len(srcs) == 0 {
+			log.Println("Error not of a page:", e)
+			return false
+		}
+		for _, src := range srcs {
+			if pathToUrl(srcFiles[src]) == fn_APP {
+				log.Println("Error in", fn_APP, "fails the whole build:", e)
+				return false
+			}
+			pages[src] = append(pages[src], e)
+		}
+	}
+
+	progress := false
+	for src, errs := range pages {
+		switch b := broken[src]; {
+		case b == nil:
+			broken[src] = m.newBrokenPage(src, errs)
+			progress = true
+		case b.good:
+			// the last good source does not build any more
+			b.good = false
+			progress = true
+		}
+	}
+	return len(pages) > 0 && progress
+}
+
+// pageSource returns the source of a page in the build folder: the
+// generated one, or a fallback if broken.
+func (m *monitor) pageSource(src string, path villa.Path, b *brokenPage, middlewares villa.StrSet) ([]byte, error) {
+	switch {
+	case b == nil:
+		return m.srcDir.Join(src + s_GO_SUFFIX).ReadFile()
+	case b.good:
+		return m.good[src], nil
+	}
+	return brokenSource(pathToUrl(path), src, b.errors, middlewares)
+}
+
+// brokenTemplate is the template of the stub source of a broken page
+var brokenTemplate = template.Must(template.New("broken").Parse(`// Code generated by geps from {{.Url}}. DO NOT EDIT.
+// The page failed to build.
+
+package main
+{{if .Middleware}}
+var __process_{{.Name}} = brokenMiddleware({{printf "%q" .Path}}, {{printf "%q" .Errors}})
+{{else}}
+func init() {
+	registerPath({{printf "%q" .Path}}, brokenPage({{printf "%q" .Path}}, {{printf "%q" .Errors}}){{range .Middlewares}},
+		middleware{ {{printf "%q" .Path}}, __process_{{.Name}} }{{end}})
+}
+{{end}}`))
+
+// brokenSource returns the stub source of a broken page, responding the
+// errors. Middlewares still apply to the page, and a broken middleware
+// never calls next.
+func brokenSource(url, name string, errs []buildError, middlewares villa.StrSet) ([]byte, error) {
+	type route struct {
+		Path, Name string
+	}
+	var mws []route
+	if !isMiddleware(url) {
+		for _, mw := range middlewaresOf(url, middlewares) {
+			mws = append(mws, route{Path: "/" + mw, Name: srcName(mw)})
+		}
+	}
+	lines := make([]string, len(errs))
+	for i, e := range errs {
+		lines[i] = e.String()
+	}
+
+	var out bytes.Buffer
+	err := brokenTemplate.Execute(&out, struct {
+		Url, Path, Name, Errors string
+		Middleware              bool
+		Middlewares             []route
+	}{
+		Url:         url,
+		Path:        "/" + url,
+		Name:        name,
+		Errors:      strings.Join(lines, "\n"),
+		Middleware:  isMiddleware(url),
+		Middlewares: mws,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(out.Bytes())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/daviddengcn/go-villa"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseBuildErrors(t *testing.T) {
+	out := `# geps/site
+./bad.gep:3:29: undefined: x
+./sub/inc.gep:1:49: undefined: y
+gep_a_dgep.go:12: syntax error
+./bad.gep:4:1: too many errors
+note: something else
+`
+	expected := []buildError{
+		{File: "bad.gep", Line: 3, Col: 29, Msg: "undefined: x"},
+		{File: "sub/inc.gep", Line: 1, Col: 49, Msg: "undefined: y"},
+		{File: "gep_a_dgep.go", Line: 12, Msg: "syntax error"},
+	}
+	if errs := parseBuildErrors(out); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, errs)
+	}
+	if s := expected[2].String(); s != "gep_a_dgep.go:12: syntax error" {
+		t.Errorf("Unexpected String(): %s", s)
+	}
+}
+
+func TestMarkBroken(t *testing.T) {
+	srcFiles := map[string]villa.Path{
+		"gep_a_dgep":     "a.gep",
+		"gep_b_dgep":     "b.gep",
+		"gep_c_dgep":     "c.gep",
+		"gep___app_dgep": "_app.gep",
+	}
+	m := &monitor{
+		pages: map[string]*pageState{
+			"gep_a_dgep": {depends: map[villa.Path]fileSig{"a.gep": {}, "inc/h.gep": {}}},
+			"gep_b_dgep": {depends: map[villa.Path]fileSig{"b.gep": {}, "inc/h.gep": {}}},
+		},
+		good: map[string][]byte{"gep_a_dgep": []byte("good a")},
+	}
+
+	broken := make(map[string]*brokenPage)
+	if !m.markBroken(broken, srcFiles, []buildError{{File: "inc/h.gep", Line: 1, Msg: "x"}}) {
+		t.Fatal("Expected pages including inc/h.gep marked broken")
+	}
+	var srcs []string
+	for src := range broken {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+	if s := strings.Join(srcs, " "); s != "gep_a_dgep gep_b_dgep" {
+		t.Errorf("Expected a.gep and b.gep broken, but got %s", s)
+	}
+	if !broken["gep_a_dgep"].good || broken["gep_b_dgep"].good {
+		t.Errorf("Expected the last good source used for a.gep only")
+	}
+
+	// the last good source fails as well
+	if !m.markBroken(broken, srcFiles, []buildError{{File: "a.gep", Line: 1, Msg: "x"}}) {
+		t.Fatal("Expected a.gep falling back to a stub")
+	}
+	if broken["gep_a_dgep"].good {
+		t.Errorf("Expected a stub for a.gep")
+	}
+	// a stub fails, no progress
+	if m.markBroken(broken, srcFiles, []buildError{{File: "gep_a_dgep.go", Line: 1, Msg: "x"}}) {
+		t.Errorf("Expected no more pages to leave out")
+	}
+	// errors not of a page, or of _app.gep
+	if m.markBroken(broken, srcFiles, []buildError{{File: "util.go", Line: 1, Msg: "x"}}) {
+		t.Errorf("Expected errors in util.go fail the build")
+	}
+	if m.markBroken(broken, srcFiles, []buildError{{File: "_app.gep", Line: 1, Msg: "x"}}) {
+		t.Errorf("Expected errors in _app.gep fail the build")
+	}
+
+	m.dev = true
+	delete(broken, "gep_a_dgep")
+	m.markBroken(broken, srcFiles, []buildError{{File: "a.gep", Line: 1, Msg: "x"}})
+	if broken["gep_a_dgep"].good {
+		t.Errorf("Expected a stub for a.gep in development mode")
+	}
+}
+
+func TestBrokenSource(t *testing.T) {
+	mws := villa.NewStrSet("_middleware.gep", "admin/_middleware.gep")
+	errs := []buildError{{File: "admin/a.gep", Line: 2, Col: 3, Msg: `undefined: "x"`}}
+
+	src, err := brokenSource("admin/a.gep", "gep_admin_sa_dgep", errs, mws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		`brokenPage("/admin/a.gep", "admin/a.gep:2:3: undefined: \"x\"")`,
+		`middleware{"/_middleware.gep", __process_gep___middleware_dgep}`,
+		`middleware{"/admin/_middleware.gep", __process_gep_admin_s__middleware_dgep}`,
+	} {
+		if !strings.Contains(string(src), s) {
+			t.Errorf("Expected %s in the stub, but got\n%s", s, src)
+		}
+	}
+
+	src, err = brokenSource("admin/_middleware.gep", "gep_admin_s__middleware_dgep", errs, mws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := `var __process_gep_admin_s__middleware_dgep = brokenMiddleware(`; !strings.Contains(string(src), s) {
+		t.Errorf("Expected %s in the stub, but got\n%s", s, src)
+	}
+}
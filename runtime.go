@@ -0,0 +1,70 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"github.com/daviddengcn/go-villa"
+	"regexp"
+)
+
+// runtimeFS holds the runtime sources written into each build folder, so
+// the geps executable works without the geps source tree.
+//
+//go:embed gepsvr/gepsvr.go utils/htmlutils.go utils/excerpt.go
+var runtimeFS embed.FS
+
+const fn_EMBED_GEPSVR = "gepsvr/gepsvr.go"
+
+// files of the utils package in runtimeFS
+var embedUtils = []string{"utils/htmlutils.go", "utils/excerpt.go"}
+
+// runtimeVersionRe matches the runtimeVersion constant in gepsvr.go
+var runtimeVersionRe = regexp.MustCompile(`(?m)^const runtimeVersion = "([^"]*)"`)
+
+// runtimeVersion returns the runtime version declared in the source of
+// gepsvr.go, or "" if not declared.
+func runtimeVersion(src []byte) string {
+	if m := runtimeVersionRe.FindSubmatch(src); m != nil {
+		return string(m[1])
+	}
+	return ""
+}
+
+// checkRuntimeVersion returns an error if the version of a gepsvr.go
+// source does not match the embedded one.
+func checkRuntimeVersion(src []byte) error {
+	embedded, err := runtimeFS.ReadFile(fn_EMBED_GEPSVR)
+	if err != nil {
+		return err
+	}
+	want, got := runtimeVersion(embedded), runtimeVersion(src)
+	if got != want {
+		return fmt.Errorf("runtime version %q does not match %q of geps", got, want)
+	}
+	return nil
+}
+
+// gepsvrSource returns the source of gepsvr.go, the embedded one or the
+// one in code.inc if set. The version of the latter is checked.
+func (m *monitor) gepsvrSource() ([]byte, error) {
+	if m.gepsvrFile == "" {
+		return runtimeFS.ReadFile(fn_EMBED_GEPSVR)
+	}
+	src, err := m.gepsvrFile.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRuntimeVersion(src); err != nil {
+		return nil, fmt.Errorf("%v: %v", m.gepsvrFile, err)
+	}
+	return src, nil
+}
+
+// writeGepsvr writes gepsvr.go into the build folder dir
+func (m *monitor) writeGepsvr(dir villa.Path) error {
+	src, err := m.gepsvrSource()
+	if err != nil {
+		return err
+	}
+	return writeIfChanged(dir.Join(fn_GEPSVR_GO), src)
+}
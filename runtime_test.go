@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/daviddengcn/go-villa"
+	"testing"
+)
+
+func TestRuntimeVersion(t *testing.T) {
+	embedded, err := runtimeFS.ReadFile(fn_EMBED_GEPSVR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtimeVersion(embedded) == "" {
+		t.Errorf("Expected runtimeVersion declared in %s", fn_EMBED_GEPSVR)
+	}
+	if err := checkRuntimeVersion(embedded); err != nil {
+		t.Errorf("Expected embedded runtime matches itself: %v", err)
+	}
+
+	inc, err := villa.Path("").TempDir("geps_inc_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inc.RemoveAll()
+	inc.Join(fn_GEPSVR_GO).WriteFile([]byte("package main\n\nconst runtimeVersion = \"0\"\n"), 0666)
+
+	m := &monitor{gepsvrFile: inc.Join(fn_GEPSVR_GO)}
+	if _, err := m.gepsvrSource(); err == nil {
+		t.Errorf("Expected error for a mismatched runtime")
+	}
+	inc.Join(fn_GEPSVR_GO).WriteFile(embedded, 0666)
+	if _, err := m.gepsvrSource(); err != nil {
+		t.Errorf("Expected no error for a matched runtime: %v", err)
+	}
+}
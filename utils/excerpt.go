@@ -0,0 +1,26 @@
+package utils
+
+import (
+	"strings"
+)
+
+// SourceLine is a line in an excerpt of a source file
+type SourceLine struct {
+	No      int
+	Text    string
+	Current bool
+}
+
+// Excerpt returns the lines of src around line, within around lines before
+// and after. The line itself is marked as the current one.
+func Excerpt(src []byte, line, around int) (excerpt []SourceLine) {
+	lines := strings.Split(strings.TrimSuffix(string(src), "\n"), "\n")
+	for no := line - around; no <= line+around; no++ {
+		if no < 1 || no > len(lines) {
+			continue
+		}
+		excerpt = append(excerpt, SourceLine{No: no,
+			Text: strings.TrimRight(lines[no-1], "\r"), Current: no == line})
+	}
+	return excerpt
+}
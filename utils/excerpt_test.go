@@ -0,0 +1,23 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestExcerpt(t *testing.T) {
+	src := []byte("line 1\r\nline 2\r\nline 3\r\n")
+	excerpt := Excerpt(src, 1, 1)
+	if len(excerpt) != 2 {
+		t.Fatalf("Expected 2 lines, but got %+v", excerpt)
+	}
+	if cur := excerpt[0]; cur.No != 1 || !cur.Current || cur.Text != "line 1" {
+		t.Errorf("Unexpected current line: %+v", cur)
+	}
+	if next := excerpt[1]; next.No != 2 || next.Current || next.Text != "line 2" {
+		t.Errorf("Unexpected next line: %+v", next)
+	}
+
+	if excerpt := Excerpt(src, 5, 1); excerpt != nil {
+		t.Errorf("Expected no lines beyond the end, but got %+v", excerpt)
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"fmt"
+	"github.com/daviddengcn/geps/gep"
+	"github.com/daviddengcn/go-villa"
+	"go/ast"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// vetFinding is a problem found by an analyzer
+type vetFinding struct {
+	pos gep.Pos
+	msg string
+}
+
+// vetPage is a parsed GEP file with its generated Go source
+type vetPage struct {
+	path  villa.Path
+	url   string
+	parts *gep.GepParts
+	// imports declared by <%!import%>, before genGoSource adds the default ones
+	imports []string
+
+	fset *token.FileSet
+	file *ast.File
+}
+
+// vetter runs analyzers over all GEP files of a web root
+type vetter struct {
+	m        *monitor
+	pages    []*vetPage
+	findings map[vetFinding]bool
+}
+
+func (v *vetter) report(pos gep.Pos, format string, args ...interface{}) {
+	v.findings[vetFinding{pos: pos, msg: fmt.Sprintf(format, args...)}] = true
+}
+
+// load parses all GEP files and their generated sources
+func (v *vetter) load() {
+	files := v.m.scanFiles()
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p.S())
+	}
+	sort.Strings(paths)
+
+	sg := sourceGenerator{m: v.m}
+	for _, p := range paths {
+		page := &vetPage{path: villa.Path(p), url: pathToUrl(villa.Path(p))}
+		parts, err := gep.ParseFile(&sg, page.path)
+		if err != nil {
+			v.report(gep.Pos{File: p, Line: 1, Col: 1}, "%v", err)
+			continue
+		}
+		page.parts = parts
+		for imp := range parts.Imports {
+			page.imports = append(page.imports, imp)
+		}
+		sort.Strings(page.imports)
+
+		name := srcName(page.url)
+		goSrc, err := genGoSource(parts, page.url, name, nil)
+		if err != nil {
+			if pe, ok := err.(*posError); ok {
+				v.report(pe.pos, "%s", pe.msg)
+			} else {
+				v.report(gep.Pos{File: p, Line: 1, Col: 1}, "%v", err)
+			}
+			v.pages = append(v.pages, page)
+			continue
+		}
+		page.fset = token.NewFileSet()
+		page.file, err = parser.ParseFile(page.fset, name+".go", goSrc, 0)
+		if err != nil {
+			if list, ok := err.(scanner.ErrorList); ok {
+				for _, e := range list {
+					v.report(tokenPos(e.Pos), "%s", e.Msg)
+				}
+			} else {
+				v.report(gep.Pos{File: p, Line: 1, Col: 1}, "%v", err)
+			}
+			page.file = nil
+		}
+		v.pages = append(v.pages, page)
+	}
+}
+
+func tokenPos(pos token.Position) gep.Pos {
+	return gep.Pos{File: pos.Filename, Line: pos.Line, Col: pos.Column}
+}
+
+// part returns the srcPart of the i-th part of page
+func (page *vetPage) part(i int) (srcPart, gep.Pos) {
+	part, _ := page.parts.Parts[i].(srcPart)
+	var pos gep.Pos
+	if i < len(page.parts.Poses) {
+		pos = page.parts.Poses[i]
+	}
+	return part, pos
+}
+
+// Contexts of an htmlContext
+const (
+	hc_TEXT = iota
+	hc_TAG_NAME
+	hc_TAG
+	hc_AFTER_EQ
+	hc_ATTR_QUOTED
+	hc_ATTR_UNQUOTED
+)
+
+// htmlContext tracks the HTML context of raw parts fed in order. It is not
+// a full HTML tokenizer, but enough for finding attributes and scripts.
+type htmlContext struct {
+	state   int
+	quote   byte
+	tagName []byte
+	script  bool
+	// tail of the content of current script element
+	tail []byte
+}
+
+func lowerByte(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c - 'A' + 'a'
+	}
+	return c
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+func (c *htmlContext) feed(src string) {
+	for i := 0; i < len(src); i++ {
+		b := src[i]
+		switch c.state {
+		case hc_TEXT:
+			if c.script {
+				c.tail = append(c.tail, lowerByte(b))
+				if len(c.tail) > len("</script") {
+					c.tail = c.tail[1:]
+				}
+				if string(c.tail) == "</script" {
+					c.script, c.tail = false, nil
+					c.state, c.tagName = hc_TAG, []byte("/script")
+				}
+				continue
+			}
+			if b == '<' {
+				c.state, c.tagName = hc_TAG_NAME, c.tagName[:0]
+			}
+
+		case hc_TAG_NAME:
+			switch {
+			case b == '>':
+				c.closeTag()
+			case isSpace(b):
+				c.state = hc_TAG
+			default:
+				c.tagName = append(c.tagName, lowerByte(b))
+			}
+
+		case hc_TAG:
+			switch b {
+			case '>':
+				c.closeTag()
+			case '=':
+				c.state = hc_AFTER_EQ
+			}
+
+		case hc_AFTER_EQ:
+			switch {
+			case b == '"' || b == '\'':
+				c.state, c.quote = hc_ATTR_QUOTED, b
+			case b == '>':
+				c.closeTag()
+			case !isSpace(b):
+				c.state = hc_ATTR_UNQUOTED
+			}
+
+		case hc_ATTR_QUOTED:
+			if b == c.quote {
+				c.state = hc_TAG
+			}
+
+		case hc_ATTR_UNQUOTED:
+			switch {
+			case b == '>':
+				c.closeTag()
+			case isSpace(b):
+				c.state = hc_TAG
+			}
+		}
+	}
+}
+
+func (c *htmlContext) closeTag() {
+	c.state = hc_TEXT
+	if string(c.tagName) == "script" {
+		c.script = true
+	}
+}
+
+// inAttr returns true if current context is in the value of an attribute
+func (c *htmlContext) inAttr() bool {
+	return c.state == hc_AFTER_EQ || c.state == hc_ATTR_QUOTED ||
+		c.state == hc_ATTR_UNQUOTED
+}
+
+// inScript returns true if current context is in the body of a script element
+func (c *htmlContext) inScript() bool {
+	return c.state == hc_TEXT && c.script
+}
+
+// callsFunc returns true if the expression calls a function named fn
+func callsFunc(expr ast.Expr, fn string) bool {
+	found := false
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if id, ok := call.Fun.(*ast.Ident); ok && id.Name == fn {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// wrappedBy returns true if the expression is a call to one of the funcs
+func wrappedBy(expr ast.Expr, funcs ...string) bool {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	id, ok := call.Fun.(*ast.Ident)
+	if !ok {
+		return false
+	}
+	for _, fn := range funcs {
+		if id.Name == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// vetEscaping checks evals in attributes not wrapped by Value() and Html()
+// used in scripts.
+func (v *vetter) vetEscaping(page *vetPage) {
+	var ctx htmlContext
+	for i := range page.parts.Parts {
+		part, pos := page.part(i)
+		switch part.kind {
+		case pk_RAW:
+			ctx.feed(part.src)
+
+		case pk_EVAL:
+			expr, err := parser.ParseExpr(part.src)
+			if err != nil {
+				continue
+			}
+			if _, ok := expr.(*ast.BasicLit); ok {
+				continue
+			}
+			if ctx.inAttr() && !wrappedBy(expr, "Value", "Query") {
+				v.report(pos, "eval in attribute value should be wrapped by Value(): %s",
+					strings.TrimSpace(part.src))
+			}
+			if ctx.inScript() && callsFunc(expr, "Html") {
+				v.report(pos, "Html() used inside <script>, use JS() instead: %s",
+					strings.TrimSpace(part.src))
+			}
+		}
+	}
+}
+
+var (
+	pkgVersionRe = regexp.MustCompile(`^v[0-9]+$`)
+	pkgSuffixRe  = regexp.MustCompile(`\.v[0-9]+$`)
+)
+
+// guessPkgName guesses the package name of an import path using common
+// conventions. An empty string is returned if no valid name can be guessed.
+func guessPkgName(imp string) string {
+	els := strings.Split(imp, "/")
+	name := els[len(els)-1]
+	if pkgVersionRe.MatchString(name) && len(els) > 1 {
+		name = els[len(els)-2]
+	}
+	name = pkgSuffixRe.ReplaceAllString(name, "")
+	name = strings.TrimPrefix(name, "go-")
+	name = strings.TrimSuffix(name, "-go")
+	name = strings.TrimSuffix(name, ".go")
+	if !token.IsIdentifier(name) {
+		return ""
+	}
+	return name
+}
+
+// vetImports checks packages imported by <%!import%> but never used
+func (v *vetter) vetImports(page *vetPage) {
+	if page.file == nil {
+		return
+	}
+	used := villa.NewStrSet()
+	ast.Inspect(page.file, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok && id.Obj == nil {
+				used.Put(id.Name)
+			}
+		}
+		return true
+	})
+
+	for _, imp := range page.imports {
+		name := guessPkgName(imp)
+		if name == "" || used.In(name) {
+			continue
+		}
+		v.report(page.parts.ImportPoses[imp], "%q imported but not used", imp)
+	}
+}
+
+// handlerBody returns the body of the generated __process_ function
+func (page *vetPage) handlerBody() *ast.BlockStmt {
+	for _, decl := range page.file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && strings.HasPrefix(fn.Name.Name, "__process_") {
+			return fn.Body
+		}
+	}
+	return nil
+}
+
+// vetRequires checks required files whose declarations are never used
+// outside themselves.
+func (v *vetter) vetRequires(page *vetPage) {
+	if page.file == nil || len(page.parts.Requires) == 0 {
+		return
+	}
+	body := page.handlerBody()
+	if body == nil {
+		return
+	}
+
+	fileOf := func(n ast.Node) string {
+		return filepath.Clean(page.fset.Position(n.Pos()).Filename)
+	}
+
+	// objects declared at the top level of the handler, by files
+	decls := make(map[string]map[*ast.Object]bool)
+	declare := func(file string, id *ast.Ident) {
+		if id.Obj == nil || id.Name == "_" {
+			return
+		}
+		if decls[file] == nil {
+			decls[file] = make(map[*ast.Object]bool)
+		}
+		decls[file][id.Obj] = true
+	}
+	for _, stmt := range body.List {
+		file := fileOf(stmt)
+		switch st := stmt.(type) {
+		case *ast.AssignStmt:
+			if st.Tok == token.DEFINE {
+				for _, lhs := range st.Lhs {
+					if id, ok := lhs.(*ast.Ident); ok {
+						declare(file, id)
+					}
+				}
+			}
+		case *ast.DeclStmt:
+			if gd, ok := st.Decl.(*ast.GenDecl); ok {
+				for _, spec := range gd.Specs {
+					switch sp := spec.(type) {
+					case *ast.ValueSpec:
+						for _, id := range sp.Names {
+							declare(file, id)
+						}
+					case *ast.TypeSpec:
+						declare(file, sp.Name)
+					}
+				}
+			}
+		}
+	}
+
+	// files using the objects, other than the declaring ones
+	used := make(map[*ast.Object]bool)
+	ast.Inspect(body, func(n ast.Node) bool {
+		id, ok := n.(*ast.Ident)
+		if !ok || id.Obj == nil {
+			return true
+		}
+		if objs := decls[fileOf(id)]; !objs[id.Obj] {
+			used[id.Obj] = true
+		}
+		return true
+	})
+
+	for req := range page.parts.Requires {
+		objs := decls[filepath.Clean(req)]
+		if len(objs) == 0 {
+			continue
+		}
+		isUsed := false
+		for obj := range objs {
+			if used[obj] {
+				isUsed = true
+				break
+			}
+		}
+		if !isUsed {
+			v.report(page.parts.DependPoses[req], "required file %q is never used", req)
+		}
+	}
+}
+
+var linkRe = regexp.MustCompile(`(?i)\b(?:href|src|action)\s*=\s*["']?([^"'\s>]+)`)
+
+// resolveLink resolves a link in the page of url to a path relative to the
+// web root. An empty string is returned for external links.
+func resolveLink(url, link string) string {
+	if strings.HasPrefix(link, "//") || strings.HasPrefix(link, "#") ||
+		strings.Contains(link, ":") {
+		return ""
+	}
+	if i := strings.IndexAny(link, "?#"); i >= 0 {
+		link = link[:i]
+	}
+	if link == "" {
+		return ""
+	}
+	dir := strings.HasSuffix(link, "/")
+	if strings.HasPrefix(link, "/") {
+		link = path.Clean(link)
+	} else {
+		link = path.Join("/", path.Dir("/"+url), link)
+	}
+	if dir {
+		link = path.Join(link, "index"+s_SUFFIX)
+	}
+	return strings.TrimPrefix(link, "/")
+}
+
+// vetLinks checks links to includeonly files in raw parts
+func (v *vetter) vetLinks() {
+	includeOnly := villa.NewStrSet()
+	for _, page := range v.pages {
+		if page.parts != nil && page.parts.IncludeOnly {
+			includeOnly.Put(page.url)
+		}
+	}
+	if len(includeOnly) == 0 {
+		return
+	}
+
+	for _, page := range v.pages {
+		if page.parts == nil {
+			continue
+		}
+		for i := range page.parts.Parts {
+			part, pos := page.part(i)
+			if part.kind != pk_RAW {
+				continue
+			}
+			for _, m := range linkRe.FindAllStringSubmatchIndex(part.src, -1) {
+				link := part.src[m[2]:m[3]]
+				if target := resolveLink(page.url, link); includeOnly.In(target) {
+					v.report(pos.Advance(part.src[:m[2]]),
+						"link to includeonly file %q", target)
+				}
+			}
+		}
+	}
+}
+
+// run runs all analyzers and returns the sorted findings
+func (v *vetter) run() []vetFinding {
+	v.findings = make(map[vetFinding]bool)
+	v.load()
+	for _, page := range v.pages {
+		if page.parts == nil {
+			continue
+		}
+		v.vetEscaping(page)
+		v.vetImports(page)
+		v.vetRequires(page)
+	}
+	v.vetLinks()
+
+	findings := make([]vetFinding, 0, len(v.findings))
+	for f := range v.findings {
+		findings = append(findings, f)
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.pos.File != b.pos.File {
+			return a.pos.File < b.pos.File
+		}
+		if a.pos.Line != b.pos.Line {
+			return a.pos.Line < b.pos.Line
+		}
+		if a.pos.Col != b.pos.Col {
+			return a.pos.Col < b.pos.Col
+		}
+		return a.msg < b.msg
+	})
+	return findings
+}
+
+// vetCommand implements "geps vet [web-root]". Findings are printed to
+// stderr in the format of go vet, and the exit code is 1 if any.
+func vetCommand(args []string) int {
+	webRoot := gPaths.webRoot
+	if len(args) > 0 {
+		webRoot = villa.Path(args[0]).AbsPath()
+	}
+	v := &vetter{m: &monitor{webDir: webRoot}}
+	findings := v.run()
+
+	wd, _ := os.Getwd()
+	for _, f := range findings {
+		file := f.pos.File
+		if strings.HasSuffix(strings.ToLower(file), s_SUFFIX) {
+			file = webRoot.Join(file).S()
+			if rel, err := filepath.Rel(wd, file); err == nil {
+				file = rel
+			}
+		}
+		fmt.Fprintf(os.Stderr, "%s:%d:%d: %s\n", file, f.pos.Line, f.pos.Col, f.msg)
+	}
+
+	if len(findings) > 0 {
+		return 1
+	}
+	return 0
+}
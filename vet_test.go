@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/daviddengcn/go-villa"
+	"strings"
+	"testing"
+)
+
+func TestVet(t *testing.T) {
+	root, err := villa.Path("").TempDir("geps_vet_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.RemoveAll()
+
+	files := map[string]string{
+		"index.gep": `<%!import "strconv", "github.com/daviddengcn/go-villa"%><%!require "funcs.gep"%><%!require "used.gep"%>
+<a href="<%= request.URL.Path %>" title="<%= Value(add(1)) %>">header.gep</a>
+<a href='/header.gep'>x</a>
+<script>var s = "<%= Html(request.URL.Path) %>";</script>
+<p><%= Html(strconv.Itoa(1)) %></p>`,
+		"funcs.gep":  `<% unused := func() {} %>`,
+		"used.gep":   `<% add := func(i int) int { return i + 1 } %>`,
+		"header.gep": `<%!includeonly%>`,
+	}
+	for fn, src := range files {
+		if err := root.Join(fn).WriteFile([]byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	v := &vetter{m: &monitor{webDir: root}}
+	var msgs []string
+	for _, f := range v.run() {
+		msgs = append(msgs, f.pos.String()+": "+f.msg)
+	}
+
+	expected := []string{
+		`index.gep:1:4: "github.com/daviddengcn/go-villa" imported but not used`,
+		`index.gep:1:60: required file "funcs.gep" is never used`,
+		`index.gep:2:13: eval in attribute value should be wrapped by Value(): request.URL.Path`,
+		`index.gep:3:10: link to includeonly file "header.gep"`,
+		`index.gep:4:21: Html() used inside <script>, use JS() instead: Html(request.URL.Path)`,
+	}
+	if strings.Join(msgs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected findings:\n%s\nbut got\n%s", strings.Join(expected, "\n"),
+			strings.Join(msgs, "\n"))
+	}
+}
+
+func TestResolveLink(t *testing.T) {
+	cases := []struct{ url, link, out string }{
+		{"a/b.gep", "c.gep", "a/c.gep"},
+		{"a/b.gep", "../c.gep?x=1", "c.gep"},
+		{"a/b.gep", "/", "index.gep"},
+		{"b.gep", "http://x.com/c.gep", ""},
+		{"b.gep", "mailto:a@b.com", ""},
+	}
+	for _, c := range cases {
+		if act := resolveLink(c.url, c.link); act != c.out {
+			t.Errorf("resolveLink(%q, %q): expected %q, but got %q", c.url, c.link, c.out, act)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"github.com/daviddengcn/go-villa"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// Milliseconds without changes before a batch of changes is reported
+	gWatchDelay time.Duration = 300
+	// Milliseconds between two scans of the polling watcher
+	gPollInterval time.Duration = 1000
+)
+
+// watcher reports paths of files changed under some folders
+type watcher interface {
+	// Events returns the channel of changed paths. It is closed when the
+	// watcher is closed.
+	Events() <-chan string
+	// Close stops watching
+	Close() error
+}
+
+// newWatcher returns a watcher of the folders. The native watcher of the
+// system is used if available and poll is false, otherwise the folders are
+// polled.
+func newWatcher(dirs []villa.Path, poll bool) watcher {
+	if !poll {
+		w, err := newNativeWatcher(dirs)
+		if err == nil {
+			return w
+		}
+		log.Println("Native watcher not available, polling:", err)
+	}
+	return newPollWatcher(dirs, gPollInterval*time.Millisecond)
+}
+
+// ignoredFile returns true for temporary and swap files of editors, which
+// are not sources of a site.
+func ignoredFile(path string) bool {
+	name := filepath.Base(path)
+	switch {
+	case name == "4913": // vim checks if the folder is writable
+		return true
+	case strings.HasSuffix(name, "~"):
+		return true
+	case strings.HasPrefix(name, ".#"): // emacs lock files
+		return true
+	case len(name) > 1 && strings.HasPrefix(name, "#") && strings.HasSuffix(name, "#"):
+		return true
+	}
+	switch filepath.Ext(name) {
+	case ".swp", ".swo", ".swx", ".tmp":
+		return true
+	}
+	return false
+}
+
+// watchChanges calls f with each batch of changed paths from w. A batch is
+// reported after no more changes for delay. Ignored files are dropped and
+// paths in a batch are unique and sorted. It returns after w is closed.
+func watchChanges(w watcher, delay time.Duration, f func(paths []string)) {
+	events := w.Events()
+	batch := make(villa.StrSet)
+	var timer <-chan time.Time
+	for {
+		select {
+		case path, ok := <-events:
+			if !ok {
+				return
+			}
+			if ignoredFile(path) {
+				continue
+			}
+			batch.Put(path)
+			timer = time.After(delay)
+		case <-timer:
+			paths := batch.Elements()
+			sort.Strings(paths)
+			batch, timer = make(villa.StrSet), nil
+			f(paths)
+		}
+	}
+}
+
+// pollWatcher is a watcher scanning the folders periodically
+type pollWatcher struct {
+	dirs     []villa.Path
+	interval time.Duration
+	events   chan string
+	done     chan struct{}
+}
+
+func newPollWatcher(dirs []villa.Path, interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		dirs:     dirs,
+		interval: interval,
+		events:   make(chan string),
+		done:     make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+func (w *pollWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+// scan returns the signatures of all files under the folders
+func (w *pollWatcher) scan() map[string]fileSig {
+	sigs := make(map[string]fileSig)
+	for _, dir := range w.dirs {
+		filepath.Walk(dir.S(), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				sigs[path] = fileSig{size: info.Size(), modTime: info.ModTime()}
+			}
+			return nil
+		})
+	}
+	return sigs
+}
+
+func (w *pollWatcher) loop() {
+	defer close(w.events)
+
+	sigs := w.scan()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-time.After(w.interval):
+		}
+
+		cur := w.scan()
+		var changed []string
+		for path, sig := range cur {
+			if old, ok := sigs[path]; !ok || old != sig {
+				changed = append(changed, path)
+			}
+		}
+		for path := range sigs {
+			if _, ok := cur[path]; !ok {
+				changed = append(changed, path)
+			}
+		}
+		sigs = cur
+
+		for _, path := range changed {
+			select {
+			case w.events <- path:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package main
+
+import (
+	"github.com/daviddengcn/go-villa"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF
+
+// inotifyWatcher is a watcher using inotify of Linux. Sub folders are
+// watched as well, including those created later.
+type inotifyWatcher struct {
+	fd     int
+	file   *os.File
+	roots  []villa.Path
+	events chan string
+	done   chan struct{}
+
+	mu   sync.Mutex
+	dirs map[int32]string
+}
+
+func newNativeWatcher(dirs []villa.Path) (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		fd: fd,
+		// a non-blocking fd is polled by the runtime, so Close stops Read
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		roots:  dirs,
+		events: make(chan string),
+		done:   make(chan struct{}),
+		dirs:   make(map[int32]string),
+	}
+	for _, dir := range dirs {
+		if err := w.addTree(dir.S()); err != nil {
+			w.file.Close()
+			return nil, err
+		}
+	}
+	go w.loop()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	return w.file.Close()
+}
+
+// addTree watches dir and all folders under it
+func (w *inotifyWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			// removed before being watched
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotifyMask)
+		if err != nil {
+			return err
+		}
+		w.mu.Lock()
+		w.dirs[int32(wd)] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// send reports a changed path, returns false if the watcher is closed
+func (w *inotifyWatcher) send(path string) bool {
+	select {
+	case w.events <- path:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *inotifyWatcher) loop() {
+	defer close(w.events)
+
+	var buf [64 << 10]byte
+	for {
+		n, err := w.file.Read(buf[:])
+		if err != nil {
+			return
+		}
+		for i := 0; i+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[i]))
+			name := buf[i+syscall.SizeofInotifyEvent : i+syscall.SizeofInotifyEvent+int(ev.Len)]
+			i += syscall.SizeofInotifyEvent + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// events lost, report the roots to trigger a full check
+				for _, root := range w.roots {
+					if !w.send(root.S()) {
+						return
+					}
+				}
+				continue
+			}
+
+			w.mu.Lock()
+			dir, ok := w.dirs[ev.Wd]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, ev.Wd)
+			}
+			w.mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			path := dir
+			if l := clen(name); l > 0 {
+				path = filepath.Join(dir, string(name[:l]))
+			}
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				w.addTree(path)
+			}
+			if !w.send(path) {
+				return
+			}
+		}
+	}
+}
+
+// clen returns the length of a NUL padded name
+func clen(name []byte) int {
+	for i, b := range name {
+		if b == 0 {
+			return i
+		}
+	}
+	return len(name)
+}
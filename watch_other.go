@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"github.com/daviddengcn/go-villa"
+)
+
+func newNativeWatcher(dirs []villa.Path) (watcher, error) {
+	return nil, errors.New("no native watcher on this system")
+}
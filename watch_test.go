@@ -0,0 +1,123 @@
+package main
+
+import (
+	"github.com/daviddengcn/go-villa"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeWatcher is a watcher whose events are sent by tests
+type fakeWatcher struct {
+	events chan string
+}
+
+func (w *fakeWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *fakeWatcher) Close() error {
+	close(w.events)
+	return nil
+}
+
+func TestIgnoredFile(t *testing.T) {
+	for _, path := range []string{"/web/.index.gep.swp", "/web/index.gep~",
+		"/web/#index.gep#", "/web/.#index.gep", "/web/4913", "/web/a.tmp"} {
+		if !ignoredFile(path) {
+			t.Errorf("Expected %s ignored", path)
+		}
+	}
+	for _, path := range []string{"/web/index.gep", "/web/#", "/web/util.go"} {
+		if ignoredFile(path) {
+			t.Errorf("Expected %s not ignored", path)
+		}
+	}
+}
+
+func TestWatchChanges(t *testing.T) {
+	w := &fakeWatcher{events: make(chan string)}
+	batches := make(chan []string, 10)
+	done := make(chan struct{})
+	go func() {
+		watchChanges(w, 50*time.Millisecond, func(paths []string) {
+			batches <- paths
+		})
+		close(done)
+	}()
+
+	// a burst of saves, with swap files of the editor
+	for _, path := range []string{"/web/b.gep", "/web/.b.gep.swp", "/web/4913",
+		"/web/a.gep", "/web/b.gep", "/web/b.gep~"} {
+		w.events <- path
+		time.Sleep(5 * time.Millisecond)
+	}
+	select {
+	case paths := <-batches:
+		if s := strings.Join(paths, " "); s != "/web/a.gep /web/b.gep" {
+			t.Errorf("Expected one batch of a.gep and b.gep, but got %s", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a batch of changes")
+	}
+
+	// only ignored files
+	w.events <- "/web/#a.gep#"
+	select {
+	case paths := <-batches:
+		t.Errorf("Expected no batch, but got %v", paths)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	w.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Expected watchChanges returned after the watcher closed")
+	}
+}
+
+// testWatcher checks a change of a file in a sub folder is reported by w
+func testWatcher(t *testing.T, w watcher, dir villa.Path) {
+	defer w.Close()
+
+	sub := dir.Join("sub")
+	sub.MkdirAll(0777)
+	time.Sleep(100 * time.Millisecond)
+	fn := sub.Join("index.gep")
+	fn.WriteFile([]byte("hello"), 0666)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case path := <-w.Events():
+			if path == fn.S() {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Expected change of %v reported", fn)
+		}
+	}
+}
+
+func TestPollWatcher(t *testing.T) {
+	dir, err := villa.Path("").TempDir("geps_watch_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.RemoveAll()
+	dir = dir.AbsPath()
+
+	testWatcher(t, newPollWatcher([]villa.Path{dir}, 20*time.Millisecond), dir)
+}
+
+func TestNewWatcher(t *testing.T) {
+	dir, err := villa.Path("").TempDir("geps_watch_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.RemoveAll()
+	dir = dir.AbsPath()
+
+	testWatcher(t, newWatcher([]villa.Path{dir}, false), dir)
+}